@@ -0,0 +1,35 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // matching utxos to addresses
+import "bufio"
+import "fmt"
+import "os"
+import "strings"
+
+// readAddresses reads a file with one address on each line (blank lines and lines starting with # are ignored)
+func readAddresses(file string) (*chainstate.AddressSet, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    addressSet := chainstate.NewAddressSet()
+    scanner := bufio.NewScanner(f)
+    line := 0
+    for scanner.Scan() {
+        line++
+        address := strings.TrimSpace(scanner.Text())
+        if address == "" || strings.HasPrefix(address, "#") {
+            continue
+        }
+        if err := addressSet.Add(address); err != nil {
+            return nil, fmt.Errorf("%s line %d: %v", file, line, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return addressSet, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bufio"
+import "container/heap" // merging spilled runs
+import "encoding/binary" // varints in spill files
+import "encoding/hex"
+import "fmt"
+import "io"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+
+// Aggregated output (-aggregate)
+//
+// Instead of one row per utxo, write one row per address (or per scriptpubkey for utxos that don't have an address):
+//
+//   address,script,type,amount,utxos,min_height,max_height
+//   1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX,,p2pkh,65279,1,123456,123456
+//   1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa,,p2pk p2pkh,5000005000,2,0,123456
+//   ,5121...52ae,p2ms,600,1,234567,234567
+//
+// An address can be locked to by more than one type of script (a p2pk and a p2pkh have the same address with -p2pkaddresses), so the type column has every type that was seen for it.
+//
+// The totals are kept in a map. If it gets bigger than the limit, the map is sorted and written to a temporary
+// file (a "run") and emptied, and at the end the runs are merged back together in order. So memory stays bounded
+// however many addresses there are, at the cost of some disk space.
+
+// aggregateTotal is what we know about an address so far
+type aggregateTotal struct {
+    amount    int64
+    utxos     int64
+    minHeight int64
+    maxHeight int64
+    types     int64 // bit for each aggregateTypes index that's been seen
+}
+
+// aggregateTypes are the script types in the order they're listed in the type column
+var aggregateTypes = []string{"p2pk", "p2pkh", "p2sh", "p2ms", "p2wpkh", "p2wsh", "p2tr", "nulldata", "non-standard"}
+
+// aggregateTypeBit gets the bit for a script type in aggregateTotal.types
+func aggregateTypeBit(scriptType string) int64 {
+    for i, t := range aggregateTypes {
+        if t == scriptType {
+            return 1 << uint(i)
+        }
+    }
+    return 0
+}
+
+// aggregateTypeNames lists the types in aggregateTotal.types (separated by spaces, the same as the lists in the ms_ fields)
+func aggregateTypeNames(types int64) string {
+    var names []string
+    for i, t := range aggregateTypes {
+        if types & (1 << uint(i)) != 0 {
+            names = append(names, t)
+        }
+    }
+    return strings.Join(names, " ")
+}
+
+// add combines the totals for the same address
+func (t *aggregateTotal) add(other aggregateTotal) {
+    if t.utxos == 0 || other.minHeight < t.minHeight {
+        t.minHeight = other.minHeight
+    }
+    if t.utxos == 0 || other.maxHeight > t.maxHeight {
+        t.maxHeight = other.maxHeight
+    }
+    t.amount += other.amount
+    t.utxos += other.utxos
+    t.types |= other.types
+}
+
+// aggregateWriter is a recordWriter that adds up the utxos for each address, and writes the totals when it's closed
+type aggregateWriter struct {
+    w      io.Writer
+    format string // csv or jsonl
+    limit  int    // number of addresses to keep in memory before spilling to disk
+
+    totals map[string]*aggregateTotal // aggregateKey -> totals
+    dir    string                     // temporary folder for runs (created on the first spill)
+    runs   []string                   // spilled run files
+}
+
+func newAggregateWriter(w io.Writer, format string, limit int) (*aggregateWriter, error) {
+    if format != "csv" && format != "jsonl" {
+        return nil, fmt.Errorf("aggregated output can only be written as csv or jsonl")
+    }
+    if limit < 1 {
+        return nil, fmt.Errorf("aggregate limit must be at least 1")
+    }
+    return &aggregateWriter{w: w, format: format, limit: limit, totals: map[string]*aggregateTotal{}}, nil
+}
+
+// aggregateKey identifies what a utxo is locked to: the address, or the scriptpubkey if there's no address (the type isn't part of it, so every type of script for the same address adds up together)
+//
+//   a 1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX
+//   s <scriptpubkey bytes>
+//
+// It's the complete scriptpubkey (the same as the scriptpubkey field) rather than the script in its storage form, so the script
+// column is the locking script you'd see in a transaction (e.g. 21<public key>ac for a p2pk, not just the public key).
+func aggregateKey(coin *chainstate.Coin) string {
+    if coin.Address != "" {
+        return "a" + coin.Address
+    }
+    return string(chainstate.AppendScriptPubKey([]byte{'s'}, coin.NSize, coin.Script))
+}
+
+// splitAggregateKey gets the address or scriptpubkey (hex) back out of a key
+func splitAggregateKey(key string) (string, string) {
+    if key[0] == 'a' {
+        return key[1:], ""
+    }
+    return "", hex.EncodeToString([]byte(key[1:]))
+}
+
+func (a *aggregateWriter) WriteHeader() error {
+    return nil // written with the totals at the end
+}
+
+func (a *aggregateWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    key := aggregateKey(coin)
+    total, ok := a.totals[key]
+    if !ok {
+        if len(a.totals) >= a.limit {
+            if err := a.spill(); err != nil {
+                return err
+            }
+        }
+        total = &aggregateTotal{}
+        a.totals[key] = total
+    }
+    total.add(aggregateTotal{amount: coin.Amount, utxos: 1, minHeight: coin.Height, maxHeight: coin.Height, types: aggregateTypeBit(coin.Type)})
+    return nil
+}
+
+// sortedKeys returns the keys of the in-memory totals in order
+func (a *aggregateWriter) sortedKeys() []string {
+    keys := make([]string, 0, len(a.totals))
+    for key := range a.totals {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// spill writes the in-memory totals to a run file (in key order) and empties the map
+//
+//   [key length (varint)] [key] [amount (varint)] [utxos (varint)] [min height (varint)] [max height (varint)] [types (varint)]
+func (a *aggregateWriter) spill() error {
+    if a.dir == "" {
+        dir, err := os.MkdirTemp("", "utxodump-aggregate-")
+        if err != nil {
+            return err
+        }
+        a.dir = dir
+    }
+
+    f, err := os.Create(fmt.Sprintf("%s/run-%05d", a.dir, len(a.runs)))
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    buf := make([]byte, binary.MaxVarintLen64)
+    for _, key := range a.sortedKeys() {
+        total := a.totals[key]
+        w.Write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+        w.WriteString(key)
+        for _, v := range []int64{total.amount, total.utxos, total.minHeight, total.maxHeight, total.types} {
+            w.Write(buf[:binary.PutVarint(buf, v)])
+        }
+    }
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+
+    a.runs = append(a.runs, f.Name())
+    a.totals = map[string]*aggregateTotal{}
+    return nil
+}
+
+// Close merges the in-memory totals with any spilled runs and writes a row for every address
+func (a *aggregateWriter) Close() error {
+    if err := a.writeHeader(); err != nil {
+        return err
+    }
+    return a.merge(a.writeRow)
+}
+
+// merge calls emit with the complete totals for every address (in key order), then deletes the spilled runs
+func (a *aggregateWriter) merge(emit func(key string, total aggregateTotal) error) error {
+    defer a.removeRuns()
+
+    // Each run (and the map) is already in key order, so merge them by always taking the smallest key next
+    runs := &aggregateHeap{}
+    for _, name := range a.runs {
+        f, err := os.Open(name)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        run := &aggregateFileRun{r: bufio.NewReader(f)}
+        if err := runs.push(run); err != nil {
+            return err
+        }
+    }
+    if err := runs.push(&aggregateMapRun{totals: a.totals, keys: a.sortedKeys()}); err != nil {
+        return err
+    }
+
+    for runs.Len() > 0 {
+
+        // add up the same key from every run it's in
+        key := (*runs)[0].key
+        var total aggregateTotal
+        for runs.Len() > 0 && (*runs)[0].key == key {
+            total.add((*runs)[0].total)
+            if err := runs.advance(); err != nil {
+                return err
+            }
+        }
+
+        if err := emit(key, total); err != nil {
+            return err
+        }
+    }
+    a.totals = map[string]*aggregateTotal{}
+    return nil
+}
+
+// removeRuns deletes the temporary run files
+func (a *aggregateWriter) removeRuns() {
+    if a.dir != "" {
+        os.RemoveAll(a.dir)
+        a.dir, a.runs = "", nil
+    }
+}
+
+func (a *aggregateWriter) writeHeader() error {
+    if a.format != "csv" {
+        return nil
+    }
+    _, err := fmt.Fprintln(a.w, "address,script,type,amount,utxos,min_height,max_height")
+    return err
+}
+
+func (a *aggregateWriter) writeRow(key string, total aggregateTotal) error {
+    address, script := splitAggregateKey(key)
+    scriptType := aggregateTypeNames(total.types)
+
+    var line []byte
+    switch a.format {
+    case "csv":
+        line = append(line, address...)
+        line = append(line, ',')
+        line = append(line, script...)
+        line = append(line, ',')
+        line = append(line, scriptType...)
+        for _, v := range []int64{total.amount, total.utxos, total.minHeight, total.maxHeight} {
+            line = append(line, ',')
+            line = strconv.AppendInt(line, v, 10)
+        }
+    case "jsonl":
+        line = append(line, `{"address":`...)
+        if address == "" {
+            line = append(line, "null"...)
+        } else {
+            line = appendJSONString(line, address)
+        }
+        line = append(line, `,"script":`...)
+        if script == "" {
+            line = append(line, "null"...)
+        } else {
+            line = appendJSONString(line, script)
+        }
+        line = append(line, `,"type":`...)
+        line = appendJSONString(line, scriptType)
+        for n, v := range []int64{total.amount, total.utxos, total.minHeight, total.maxHeight} {
+            line = append(line, `,"`...)
+            line = append(line, []string{"amount", "utxos", "min_height", "max_height"}[n]...)
+            line = append(line, `":`...)
+            line = strconv.AppendInt(line, v, 10)
+        }
+        line = append(line, '}')
+    }
+    line = append(line, '\n')
+
+    _, err := a.w.Write(line)
+    return err
+}
+
+// aggregateRun is a sorted source of totals (a spilled file or the in-memory map)
+type aggregateRun interface {
+    next() (string, aggregateTotal, error) // returns io.EOF at the end
+}
+
+// aggregateFileRun reads the totals back from a spilled run file
+type aggregateFileRun struct {
+    r *bufio.Reader
+}
+
+func (f *aggregateFileRun) next() (string, aggregateTotal, error) {
+    size, err := binary.ReadUvarint(f.r)
+    if err != nil {
+        return "", aggregateTotal{}, err // io.EOF at the end of the run
+    }
+    key := make([]byte, size)
+    if _, err := io.ReadFull(f.r, key); err != nil {
+        return "", aggregateTotal{}, err
+    }
+    var values [5]int64
+    for n := range values {
+        if values[n], err = binary.ReadVarint(f.r); err != nil {
+            return "", aggregateTotal{}, err
+        }
+    }
+    return string(key), aggregateTotal{amount: values[0], utxos: values[1], minHeight: values[2], maxHeight: values[3], types: values[4]}, nil
+}
+
+// aggregateMapRun returns the in-memory totals in key order
+type aggregateMapRun struct {
+    totals map[string]*aggregateTotal
+    keys   []string
+}
+
+func (m *aggregateMapRun) next() (string, aggregateTotal, error) {
+    if len(m.keys) == 0 {
+        return "", aggregateTotal{}, io.EOF
+    }
+    key := m.keys[0]
+    m.keys = m.keys[1:]
+    return key, *m.totals[key], nil
+}
+
+// aggregateCursor is the current key and totals of a run
+type aggregateCursor struct {
+    run   aggregateRun
+    key   string
+    total aggregateTotal
+}
+
+// aggregateHeap keeps the runs ordered by their current key (smallest first)
+type aggregateHeap []*aggregateCursor
+
+func (h aggregateHeap) Len() int           { return len(h) }
+func (h aggregateHeap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h aggregateHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *aggregateHeap) Push(x interface{}) { *h = append(*h, x.(*aggregateCursor)) }
+func (h *aggregateHeap) Pop() interface{} {
+    old := *h
+    x := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return x
+}
+
+// push adds a run to the heap (unless it's empty)
+func (h *aggregateHeap) push(run aggregateRun) error {
+    key, total, err := run.next()
+    if err == io.EOF {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    heap.Push(h, &aggregateCursor{run: run, key: key, total: total})
+    return nil
+}
+
+// advance moves the run with the smallest key on to its next key
+func (h *aggregateHeap) advance() error {
+    cursor := (*h)[0]
+    key, total, err := cursor.run.next()
+    if err == io.EOF {
+        heap.Pop(h)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    cursor.key, cursor.total = key, total
+    heap.Fix(h, 0)
+    return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bytes"
+import "encoding/hex"
+import "testing"
+
+// TestAggregateByAddress checks that different script types for the same address add up in one row (with and without spilling to disk)
+func TestAggregateByAddress(t *testing.T) {
+    compressed, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798") // secp256k1 generator
+    uncompressed, _ := hex.DecodeString("0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+    coins := []*chainstate.Coin{
+        {Height: 0, Amount: 5000000000, Type: "p2pk", Script: []byte{0x04}, Address: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"},
+        {Height: 200, Amount: 700, Type: "p2sh", Script: []byte{0x05}, Address: "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw"},
+        {Height: 123456, Amount: 5000, Type: "p2pkh", Script: []byte{0x06}, Address: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"},
+        {Height: 300, Amount: 600, Type: "p2ms", NSize: 6 + 2, Script: []byte{0x51, 0xae}},
+        {Height: 400, Amount: 1, Type: "p2ms", NSize: 6 + 2, Script: []byte{0x51, 0xae}},
+
+        // p2pk without addresses (keyed and written as the scriptpubkey, not just the public key)
+        {Height: 10, Amount: 50, Type: "p2pk", NSize: 2, Script: compressed},
+        {Height: 20, Amount: 60, Type: "p2pk", NSize: 4, Script: uncompressed},
+        {Height: 30, Amount: 70, Type: "p2pk", NSize: 2, Script: compressed},
+    }
+    want := "address,script,type,amount,utxos,min_height,max_height\n" +
+        "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa,,p2pk p2pkh,5000005000,2,0,123456\n" +
+        "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw,,p2sh,700,1,200,200\n" +
+        ",21" + hex.EncodeToString(compressed) + "ac,p2pk,120,2,10,30\n" +
+        ",41" + hex.EncodeToString(uncompressed) + "ac,p2pk,60,1,20,20\n" +
+        ",51ae,p2ms,601,2,300,400\n"
+
+    for _, limit := range []int{100, 1} { // 1 spills every time there's a new key
+        var buf bytes.Buffer
+        a, err := newAggregateWriter(&buf, "csv", limit)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i, coin := range coins {
+            if err := a.WriteRecord(i+1, coin); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := a.Close(); err != nil {
+            t.Fatal(err)
+        }
+        if buf.String() != want {
+            t.Errorf("limit %d:\n%s\nwant:\n%s", limit, buf.String(), want)
+        }
+    }
+}
@@ -0,0 +1,294 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128 for the keys
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "github.com/syndtr/goleveldb/leveldb"                     // writing the synthetic chainstate
+import "crypto/sha256"
+import "flag"
+import "fmt"
+import "io"
+import "math/rand"
+import "os"
+import "runtime"
+import "testing"
+
+// Benchmarks
+//
+// Measure how fast the utxos get read, decoded and written, so changes to the decode path can be checked against real numbers:
+//
+//   go test -bench . -run '^$'
+//
+//   BenchmarkKeys         300000     387.5 ns/op     72 B/op    0 allocs/op
+//   BenchmarkDecode       300000      1200 ns/op    102 B/op    0 allocs/op
+//   BenchmarkAddresses    300000      3316 ns/op    149 B/op    1 allocs/op   <- the address string
+//   BenchmarkCSV          300000      3991 ns/op    149 B/op    1 allocs/op
+//   ...
+//
+// Each op is one utxo. They use a synthetic chainstate written to a temporary folder first (obfuscated, with a mix of script types a bit like mainnet), so the numbers can be compared between machines and versions. Use -benchdb to run them on a real chainstate instead.
+
+// benchScripts are the scripts used in the synthetic chainstate, and roughly how often each one turns up (out of 100)
+var benchScripts = []struct {
+    nsize  int64
+    size   int // bytes of random hash (or the whole script for the fixed ones)
+    script []byte
+    weight int
+}{
+    {0, 20, nil, 30},  // p2pkh
+    {1, 20, nil, 10},  // p2sh
+    {6 + 22, 0, []byte{0x00, 0x14}, 25}, // p2wpkh (followed by the 20 byte hash)
+    {6 + 34, 0, []byte{0x00, 0x20}, 5},  // p2wsh (followed by the 32 byte hash)
+    {6 + 34, 0, []byte{0x51, 0x20}, 20}, // p2tr (followed by the 32 byte key)
+    {2, 0, nil, 3},  // p2pk (compressed)
+    {4, 0, nil, 1},  // p2pk (uncompressed, so the public key gets decompressed when it's decoded)
+    {6 + 71, 0, nil, 3}, // p2ms (1 of 2)
+    {6 + 3, 0, []byte{0x6a, 0x01, 0x42}, 2}, // OP_RETURN
+    {6 + 1, 0, []byte{0x51}, 1}, // non-standard
+}
+
+// benchPublicKey is the generator point G (a valid public key, so decompressing it works)
+var benchPublicKey = []byte{0x02, 0x79, 0xbe, 0x66, 0x7e, 0xf9, 0xdc, 0xbb, 0xac, 0x55, 0xa0, 0x62, 0x95, 0xce, 0x87, 0x0b, 0x07, 0x02, 0x9b, 0xfc, 0xdb, 0x2d, 0xce, 0x28, 0xd9, 0x59, 0xf2, 0x81, 0x5b, 0x16, 0xf8, 0x17, 0x98}
+
+// benchObfuscateKey is the obfuscate key for the synthetic chainstate
+var benchObfuscateKey = []byte{0xb1, 0x2d, 0xce, 0xfd, 0x8f, 0x87, 0x25, 0x36}
+
+// benchCoin makes a random coin for the synthetic chainstate
+func benchCoin(r *rand.Rand, n int) chainstate.Coin {
+
+    // A few outputs for each transaction
+    txid := sha256.Sum256([]byte(fmt.Sprint(n / 3)))
+    coin := chainstate.Coin{
+        TxID:     txid[:],
+        Vout:     int64(n % 3),
+        Height:   int64(r.Intn(900000)),
+        Coinbase: r.Intn(100) == 0,
+        Amount:   []int64{546, 1000, 10000, 123456, 5000000, 100000000, 5000000000}[r.Intn(7)],
+    }
+
+    // Script
+    pick := r.Intn(100)
+    for _, s := range benchScripts {
+        if pick >= s.weight {
+            pick -= s.weight
+            continue
+        }
+        coin.NSize = s.nsize
+        switch {
+        case s.size > 0: // hash160
+            coin.Script = make([]byte, s.size)
+            r.Read(coin.Script)
+        case s.nsize == 2:
+            coin.Script = benchPublicKey
+        case s.nsize == 4: // only the x coordinate is stored, so the y coordinate can be anything here
+            coin.Script = append([]byte{0x04}, benchPublicKey[1:]...)
+            coin.Script = append(coin.Script, make([]byte, 32)...)
+        case s.nsize == 6+71: // OP_1 <pubkey> <pubkey> OP_2 OP_CHECKMULTISIG
+            coin.Script = append([]byte{0x51, 0x21}, benchPublicKey...)
+            coin.Script = append(coin.Script, 0x21)
+            coin.Script = append(coin.Script, benchPublicKey...)
+            coin.Script = append(coin.Script, 0x52, 0xae)
+        case s.nsize == 6+22 || s.nsize == 6+34: // witness program
+            coin.Script = append([]byte{}, s.script...)
+            program := make([]byte, s.nsize-6-2)
+            r.Read(program)
+            coin.Script = append(coin.Script, program...)
+        default:
+            coin.Script = s.script
+        }
+        break
+    }
+
+    return coin
+}
+
+// writeBenchChainstate writes a synthetic chainstate with a number of coins to a folder
+func writeBenchChainstate(folder string, coins int) error {
+    r := rand.New(rand.NewSource(1)) // the same coins every time
+    all := make([]chainstate.Coin, coins)
+    for n := range all {
+        all[n] = benchCoin(r, n)
+    }
+    return writeTestChainstate(folder, all)
+}
+
+// writeTestChainstate writes a chainstate with the given coins to a folder
+func writeTestChainstate(folder string, coins []chainstate.Coin) error {
+
+    db, err := leveldb.OpenFile(folder, nil)
+    if err != nil {
+        return err
+    }
+
+    // Obfuscate key (the first byte is its size)
+    if err := db.Put([]byte("\x0e\x00obfuscate_key"), append([]byte{byte(len(benchObfuscateKey))}, benchObfuscateKey...), nil); err != nil {
+        db.Close()
+        return err
+    }
+
+    // Coins
+    //
+    //   key:   [C] [txid (little-endian)] [vout (varint)]
+    //   value: the coin as it's stored in the chainstate, obfuscated (xor-ing it with the key again is what deobfuscates it)
+    batch := new(leveldb.Batch)
+    var value []byte
+    for n := range coins {
+        coin := &coins[n]
+
+        key := []byte{67} // 67 = 0x43 = C
+        for i := len(coin.TxID) - 1; i >= 0; i-- {
+            key = append(key, coin.TxID[i])
+        }
+        key = append(key, btcleveldb.Varint128Encode(coin.Vout)...)
+
+        value = chainstate.EncodeValue(value[:0], coin)
+        batch.Put(key, chainstate.AppendDeobfuscated(nil, value, benchObfuscateKey))
+
+        if batch.Len() == 10000 {
+            if err := db.Write(batch, nil); err != nil {
+                db.Close()
+                return err
+            }
+            batch.Reset()
+        }
+    }
+    if err := db.Write(batch, nil); err != nil {
+        db.Close()
+        return err
+    }
+
+    return db.Close()
+}
+
+// benchCoins is the number of utxos in the synthetic chainstate
+const benchCoins = 100000
+
+// benchDB is a real chainstate to use instead of the synthetic one (go test -bench . -benchdb ~/.bitcoin/chainstate/)
+var benchDB = flag.String("benchdb", "", "Location of a chainstate to benchmark instead of a synthetic one. (Make sure bitcoind isn't running.)")
+
+// benchFolder is the synthetic chainstate (written the first time a benchmark needs it, and removed by TestMain)
+var benchFolder string
+
+func TestMain(m *testing.M) {
+    flag.Parse()
+    code := m.Run()
+    if benchFolder != "" {
+        os.RemoveAll(benchFolder)
+    }
+    os.Exit(code)
+}
+
+// benchChainstate gets the folder of the chainstate to benchmark
+func benchChainstate(b *testing.B) string {
+    if *benchDB != "" {
+        return *benchDB
+    }
+    if benchFolder == "" {
+        folder, err := os.MkdirTemp("", "utxobench")
+        if err != nil {
+            b.Fatal(err)
+        }
+        if err := writeBenchChainstate(folder, benchCoins); err != nil {
+            os.RemoveAll(folder)
+            b.Fatal(err)
+        }
+        benchFolder = folder
+    }
+    return benchFolder
+}
+
+// benchFields are the fields written by the output format benchmarks
+var benchFields = []string{"count", "txid", "vout", "height", "coinbase", "amount", "nsize", "script", "type", "address"}
+
+// runBench reads b.N utxos (going back to the start of the chainstate when it runs out), and writes them in a format if there is one. So allocs/op is the allocations for each utxo.
+func runBench(b *testing.B, options chainstate.Options, workers int, format string) {
+    folder := benchChainstate(b)
+
+    var out recordWriter
+    if format != "" {
+        var err error
+        out, err = newRecordWriter(format, io.Discard, benchFields, &formatOptions{rowGroupSize: benchCoins})
+        if err != nil {
+            b.Fatal(err)
+        }
+        if err := out.WriteHeader(); err != nil {
+            b.Fatal(err)
+        }
+    }
+
+    iter, _, err := openChainstate(folder, &options, workers, true)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if !iter.Next() { // start again (opening the chainstate isn't counted)
+            b.StopTimer()
+            if err := iter.Err(); err != nil {
+                b.Fatal(err)
+            }
+            iter.Close()
+            iter, _, err = openChainstate(folder, &options, workers, true)
+            if err != nil {
+                b.Fatal(err)
+            }
+            if !iter.Next() {
+                b.Fatal("there are no utxos in the chainstate")
+            }
+            b.StartTimer()
+        }
+        if out != nil {
+            if err := out.WriteRecord(i+1, iter.Coin()); err != nil {
+                b.Fatal(err)
+            }
+        }
+    }
+    b.StopTimer()
+
+    if err := iter.Err(); err != nil {
+        b.Fatal(err)
+    }
+    iter.Close()
+    if out != nil {
+        if err := out.Close(); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+// Reading the keys only (txid and vout)
+func BenchmarkKeys(b *testing.B) {
+    runBench(b, chainstate.Options{KeyOnly: true}, 1, "")
+}
+
+// Decoding the values too, but not the addresses
+func BenchmarkDecode(b *testing.B) {
+    runBench(b, chainstate.Options{NoAddress: true}, 1, "")
+}
+
+// Decoding everything
+func BenchmarkAddresses(b *testing.B) {
+    runBench(b, chainstate.Options{}, 1, "")
+}
+
+// Decoding everything on all the cpus
+func BenchmarkParallel(b *testing.B) {
+    runBench(b, chainstate.Options{}, runtime.NumCPU(), "")
+}
+
+// Decoding everything and writing it in each of the output formats
+func BenchmarkCSV(b *testing.B) {
+    runBench(b, chainstate.Options{}, 1, "csv")
+}
+
+func BenchmarkJSONL(b *testing.B) {
+    runBench(b, chainstate.Options{}, 1, "jsonl")
+}
+
+func BenchmarkPgcopy(b *testing.B) {
+    runBench(b, chainstate.Options{}, 1, "pgcopy")
+}
+
+func BenchmarkParquet(b *testing.B) {
+    runBench(b, chainstate.Options{}, 1, "parquet")
+}
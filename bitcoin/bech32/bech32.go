@@ -250,3 +250,87 @@ func SegwitAddrEncode(hrp string, version int, program []int) (string, error) {
     }
     return ret, nil
 }
+
+// AppendSegwitAddr appends the Segwit Address for hrp(human-readable part, lowercase), version(int) and program(bytes) to b / or error
+// It gives the same address as SegwitAddrEncode, but works on bytes instead of int arrays so nothing gets allocated (if b has room)
+func AppendSegwitAddr(b []byte, hrp string, version int, program []byte) ([]byte, error) {
+    if version < 0 || version > 16 {
+        return b, fmt.Errorf("invalid witness version : %d", version)
+    }
+    if len(program) < 2 || len(program) > 40 {
+        return b, fmt.Errorf("invalid program length : %d", len(program))
+    }
+    if version == 0 && len(program) != 20 && len(program) != 32 {
+        return b, fmt.Errorf("invalid program length for witness version 0 (per BIP141) : %d", len(program))
+    }
+    if len(hrp) < 1 {
+        return b, fmt.Errorf("invalid hrp : hrp=%v", hrp)
+    }
+    for p, c := range hrp {
+        if c < 33 || c > 126 || (c >= 'A' && c <= 'Z') {
+            return b, fmt.Errorf("invalid character human-readable part : hrp[%d]=%d", p, c)
+        }
+    }
+    constant := bech32mConst
+    if version == 0 {
+        constant = 1
+    }
+
+    // version and program (converted from 8 bit to 5 bit groups)
+    var buffer [90]byte
+    data := append(buffer[:0], byte(version))
+    acc, bits := 0, uint(0)
+    for _, v := range program {
+        acc = (acc<<8 | int(v)) & 0xfff // only the bits that haven't been used yet are needed
+        bits += 8
+        for bits >= 5 {
+            bits -= 5
+            data = append(data, byte((acc>>bits)&31))
+        }
+    }
+    if bits > 0 {
+        data = append(data, byte((acc<<(5-bits))&31))
+    }
+    if (len(hrp) + len(data) + 7) > 90 {
+        return b, fmt.Errorf("too long : hrp length=%d, data length=%d", len(hrp), len(data))
+    }
+
+    // checksum (the same as polymod over hrpExpand(hrp) + data + six zeros)
+    chk := 1
+    for i := 0; i < len(hrp); i++ {
+        chk = polymodStep(chk, int(hrp[i]>>5))
+    }
+    chk = polymodStep(chk, 0)
+    for i := 0; i < len(hrp); i++ {
+        chk = polymodStep(chk, int(hrp[i]&31))
+    }
+    for _, v := range data {
+        chk = polymodStep(chk, int(v))
+    }
+    for i := 0; i < 6; i++ {
+        chk = polymodStep(chk, 0)
+    }
+    mod := chk ^ constant
+
+    b = append(b, hrp...)
+    b = append(b, '1')
+    for _, v := range data {
+        b = append(b, charset[v])
+    }
+    for p := 0; p < 6; p++ {
+        b = append(b, charset[(mod>>uint(5*(5-p)))&31])
+    }
+    return b, nil
+}
+
+// polymodStep adds one value to a polymod checksum
+func polymodStep(chk int, v int) int {
+    top := chk >> 25
+    chk = (chk&0x1ffffff)<<5 ^ v
+    for i := 0; i < 5; i++ {
+        if (top>>uint(i))&1 == 1 {
+            chk ^= generator[i]
+        }
+    }
+    return chk
+}
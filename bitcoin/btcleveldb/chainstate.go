@@ -4,27 +4,21 @@ import "math"          // math.Pow() in decompress_value()
 
 func Varint128Read(bytes []byte, offset int) ([]byte, int) { // take a byte array and return (byte array and number of bytes read)
 
-    // store bytes
-    result := []byte{} // empty byte slice
-
     // loop through bytes
-    for _, v := range bytes[offset:] { // start reading from an offset
-
-        // store each byte as you go
-        result = append(result, v)
+    for i, v := range bytes[offset:] { // start reading from an offset
 
         // Bitwise AND each of them with 128 (0b10000000) to check if the 8th bit has been set
         set := v & 128 // 0b10000000 is same as 1 << 7
 
-        // When you get to one without the 8th bit set, return that byte slice
+        // When you get to one without the 8th bit set, return the bytes up to here (a slice of the original, so nothing gets copied)
         if set == 0 {
-            return result, len(result)
+            return bytes[offset : offset+i+1], i + 1
             // Also return the number of bytes read
         }
     }
 
     // Return zero bytes read if we haven't managed to read bytes properly
-    return result, 0
+    return bytes[offset:], 0
 
 }
 
@@ -98,3 +92,43 @@ func DecompressValue(x int64) int64 {
     return int64(result)
 
 }
+
+func Varint128Encode(n int64) []byte { // opposite of Varint128Decode (used when writing coins back out)
+
+    // build the bytes backwards, starting with the last 7 bits (the only byte without the 8th bit set)
+    bytes := []byte{byte(n & 127)}
+
+    for n > 127 {
+        // take 1 away each time (Varint128Decode adds it back on for every byte with the 8th bit set)
+        n = (n >> 7) - 1
+        bytes = append([]byte{byte(n & 127) | 128}, bytes...)
+    }
+
+    return bytes
+
+}
+
+func CompressValue(n int64) int64 { // opposite of DecompressValue
+
+    // Return value if it is zero (nothing to compress)
+    if n == 0 {
+        return 0
+    }
+
+    // Remove trailing zeros (up to 9 of them), counting them in e
+    var e int64 = 0
+    for n % 10 == 0 && e < 9 {
+        n = n / 10
+        e++
+    }
+
+    // If there are fewer than 9 zeros, the last digit (never 0) gets stored too
+    if e < 9 {
+        d := n % 10 // last digit (1-9)
+        n = n / 10
+        return 1 + (n * 9 + d - 1) * 10 + e
+    }
+
+    return 1 + (n - 1) * 10 + 9
+
+}
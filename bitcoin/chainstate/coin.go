@@ -0,0 +1,326 @@
+// Package chainstate decodes the unspent transaction outputs (coins) stored in Bitcoin Core's chainstate LevelDB.
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128 and amount decompression
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/keys"       // bitcoin addresses
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/bech32"     // segwit bitcoin addresses
+import "errors"
+
+// Coin is a single decoded UTXO from the chainstate.
+type Coin struct {
+    TxID     []byte    // transaction id (big-endian, the way it's usually displayed)
+    Vout     int64     // index of the output in the transaction
+    Height   int64     // height of the block the transaction was mined in
+    Coinbase bool      // whether the output is from a coinbase transaction
+    Amount   int64     // value of the output in satoshis
+    NSize    int64     // script type/size indicator used to compress the script in the database
+    Script   []byte    // script in its storage form (hash160 for P2PKH/P2SH, public key for P2PK, complete script otherwise)
+    Type     string    // p2pk, p2pkh, p2sh, p2ms, p2wpkh, p2wsh, p2tr, nulldata or non-standard
+    Address  string    // address the output is locked to (empty if it doesn't have one)
+    Multisig *Multisig // public keys etc. for a p2ms script (only with Options.Multisig, nil for other types)
+}
+
+// Options control how much of each coin gets decoded.
+type Options struct {
+    Network           string // network the addresses are for (main, test, testnet4, signet or regtest - empty is main)
+    P2PKAddresses     bool   // convert public keys in P2PK scripts to addresses also
+    KeyOnly           bool   // only decode the txid and vout from the key (skips deobfuscating the value)
+    NoAddress         bool   // do not encode addresses (the script type is still set)
+    Multisig          bool   // decode the public keys in p2ms scripts (Coin.Multisig)
+    MultisigAddresses bool   // also convert the public keys in p2ms scripts to p2pkh addresses
+
+    // Filter skips coins it returns false for. It is called after the value has been decoded but before the address is encoded (so non-matching coins don't cost an address encoding).
+    // A ParallelIterator calls it from several goroutines at once.
+    Filter func(coin *Coin) bool
+}
+
+// ErrMalformed is returned when a key or value in the chainstate can't be decoded.
+var ErrMalformed = errors.New("chainstate: malformed coin")
+
+// Deobfuscate XORs a value with the obfuscateKey (repeated to the length of the value).
+func Deobfuscate(value []byte, obfuscateKey []byte) []byte {
+
+    //   value: 71a9e87d62de25953e189f706bcf59263f15de1bf6c893bda9b045 <- obfuscated
+    //          b12dcefd8f872536b12dcefd8f872536b12dcefd8f872536b12dce <- extended obfuscateKey (XOR)
+    //          c0842680ed5900a38f35518de4487c108e3810e6794fb68b189d8b <- deobfuscated
+    return AppendDeobfuscated(make([]byte, 0, len(value)), value, obfuscateKey)
+}
+
+// AppendDeobfuscated appends the deobfuscated value to b (so a buffer can be reused for every value).
+func AppendDeobfuscated(b []byte, value []byte, obfuscateKey []byte) []byte {
+    start := len(b)
+    b = append(b, value...)
+    if len(obfuscateKey) == 0 { // no key means the value was never obfuscated
+        return b
+    }
+    xor := b[start:]
+    for i := range xor {
+        xor[i] ^= obfuscateKey[i % len(obfuscateKey)]
+    }
+    return b
+}
+
+// DecodeKey gets the txid and vout from a coin's key.
+func DecodeKey(key []byte) ([]byte, int64, error) {
+
+    //      430000155b9869d56c66d9e86e3c01de38e3892a42b99949fe109ac034fff6583900
+    //      <><--------------------------------------------------------------><>
+    //      /                               |                                  \
+    //  type                          txid (little-endian)                      index (varint)
+    txid := make([]byte, 32)
+    vout, err := decodeKey(txid, key)
+    if err != nil {
+        return nil, 0, err
+    }
+    return txid, vout, nil
+}
+
+// decodeKey is DecodeKey with the txid written to a 32 byte slice (so the iterator can reuse one for every coin).
+func decodeKey(txid []byte, key []byte) (int64, error) {
+    if len(key) < 34 || key[0] != 67 { // 67 = 0x43 = C = "utxo"
+        return 0, ErrMalformed
+    }
+
+    // txid - reverse byte order
+    txidLE := key[1:33] // little-endian byte order
+    for i := range txidLE {
+        txid[i] = txidLE[len(txidLE)-1-i]
+    }
+
+    // vout - convert varint128 index to an integer
+    index, bytesRead := btcleveldb.Varint128Read(key, 33)
+    if bytesRead == 0 {
+        return 0, ErrMalformed
+    }
+    return btcleveldb.Varint128Decode(index), nil
+}
+
+// DecodeValue fills in the height, coinbase, amount, nsize, script, type and address of a coin from its deobfuscated value.
+func DecodeValue(coin *Coin, value []byte, options *Options) error {
+
+    //          c0842680ed5900a38f35518de4487c108e3810e6794fb68b189d8b <- deobfuscated
+    //          <----><----><><-------------------------------------->
+    //           /      |    \                   |
+    //      varint   varint   varint          script <- P2PKH/P2SH hash160, P2PK public key, or complete script
+    //         |        |     nSize
+    //         |        |
+    //         |     amount (compressesed)
+    //         |
+    //         |
+    //  100000100001010100110
+    //  <------------------> \
+    //         height         coinbase
+
+    offset := 0
+
+    // First Varint - height and coinbase
+    varint, bytesRead := btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 {
+        return ErrMalformed
+    }
+    offset += bytesRead
+    varintDecoded := btcleveldb.Varint128Decode(varint)
+    coin.Height = varintDecoded >> 1 // right-shift to remove last bit
+    coin.Coinbase = varintDecoded & 1 == 1 // AND to extract right-most bit
+
+    // Amount, nSize and script
+    end, err := decodeTxOut(coin, value, offset)
+    if err != nil {
+        return err
+    }
+    if coin.NSize < 6 && end != len(value) { // compressed scripts are a fixed size, so there shouldn't be anything after them
+        return ErrMalformed
+    }
+
+    // Address
+    options.encode(coin)
+
+    return nil
+}
+
+// encode adds what's worked out from the script after decoding (and filtering): the address, and the details of a multisig script
+func (options *Options) encode(coin *Coin) {
+    if options.KeyOnly {
+        return
+    }
+    if !options.NoAddress {
+        coin.Address = Address(coin.Type, coin.Script, options.Network, options.P2PKAddresses)
+    }
+    if options.Multisig && coin.Type == "p2ms" {
+        coin.Multisig = decodeMultisig(coin.Script, options.Network, options.MultisigAddresses)
+    }
+}
+
+// decodeTxOut fills in the amount, nsize, script and type of a coin from the part of a value starting at offset, and returns the offset of the byte after the script.
+func decodeTxOut(coin *Coin, value []byte, offset int) (int, error) {
+
+    // Varint - amount (compressed)
+    varint, bytesRead := btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 {
+        return 0, ErrMalformed
+    }
+    offset += bytesRead
+    coin.Amount = btcleveldb.DecompressValue(btcleveldb.Varint128Decode(varint))
+
+    // Varint - nSize
+    varint, bytesRead = btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 {
+        return 0, ErrMalformed
+    }
+    offset += bytesRead
+    coin.NSize = btcleveldb.Varint128Decode(varint)
+
+    // Move offset back a byte if script type is 2, 3, 4, or 5 (because this forms part of the P2PK public key along with the actual script)
+    if coin.NSize > 1 && coin.NSize < 6 {
+        offset--
+    }
+
+    // Size of the script (compressed scripts are a fixed size, the rest have their size in nSize)
+    var size int64
+    switch {
+    case coin.NSize < 2:
+        size = 20
+    case coin.NSize < 6:
+        size = 33
+    default:
+        size = coin.NSize - 6
+    }
+
+    // Make sure there's enough script (otherwise the script type checks will panic)
+    if int64(len(value)-offset) < size {
+        return 0, ErrMalformed
+    }
+    script := value[offset : offset+int(size)]
+
+    // Decompress the public keys from P2PK scripts that were uncompressed originally. They got compressed just for storage in the database.
+    if coin.NSize == 4 || coin.NSize == 5 {
+        script = keys.DecompressPublicKey(script)
+    }
+    coin.Script = script
+
+    // Script type
+    coin.Type = ScriptType(coin.NSize, coin.Script)
+
+    return offset + int(size), nil
+}
+
+// EncodeValue appends a coin in the form it's stored in the chainstate (before obfuscation) to b. It's the opposite of DecodeValue, and is also how coins are stored in snapshot files.
+func EncodeValue(b []byte, coin *Coin) []byte {
+
+    // height and coinbase
+    code := coin.Height << 1
+    if coin.Coinbase {
+        code |= 1
+    }
+    b = append(b, btcleveldb.Varint128Encode(code)...)
+
+    // amount (compressed)
+    b = append(b, btcleveldb.Varint128Encode(btcleveldb.CompressValue(coin.Amount))...)
+
+    // nsize and script
+    switch {
+    case coin.NSize < 2: // hash160
+        b = append(b, btcleveldb.Varint128Encode(coin.NSize)...)
+        return append(b, coin.Script...)
+    case coin.NSize < 6: // nsize is the first byte of the public key, followed by the x coordinate (uncompressed public keys get compressed again)
+        b = append(b, byte(coin.NSize))
+        return append(b, coin.Script[1:33]...)
+    }
+    b = append(b, btcleveldb.Varint128Encode(int64(len(coin.Script))+6)...)
+    return append(b, coin.Script...)
+}
+
+// ScriptType works out the type of locking script from the nsize and the script in its storage form.
+func ScriptType(nsize int64, script []byte) string {
+
+    //  0  = P2PKH <- hash160 public key
+    //  1  = P2SH  <- hash160 script
+    //  2  = P2PK 02publickey <- nsize makes up part of the public key in the actual script
+    //  3  = P2PK 03publickey
+    //  4  = P2PK 04publickey (uncompressed - but has been compressed in to leveldb) y=even
+    //  5  = P2PK 04publickey (uncompressed - but has been compressed in to leveldb) y=odd
+    //  6+ = [size of the upcoming script] (subtract 6 though to get the actual size in bytes, to account for the previous 5 script types already taken)
+    switch {
+    case nsize == 0:
+        return "p2pkh"
+    case nsize == 1:
+        return "p2sh"
+    case 1 < nsize && nsize < 6: // 2, 3, 4, 5
+        return "p2pk"
+    case len(script) > maxScriptSize || isNullData(script): // OP_RETURN <pushes> (see nulldata.go)
+        return "nulldata"
+    case nsize == 28 && script[0] == 0 && script[1] == 20: // P2WPKH (script type is 28, which means length of script is 22 bytes)
+        return "p2wpkh"
+    case nsize == 40 && script[0] == 0 && script[1] == 32: // P2WSH (script type is 40, which means length of script is 34 bytes; 0x00 means segwit v0)
+        return "p2wsh"
+    case nsize == 40 && script[0] == 0x51 && script[1] == 32: // P2TR (script type is 40, which means length of script is 34 bytes; 0x51 means segwit v1 = taproot)
+        return "p2tr"
+    case nsize >= 6 && isMultisig(script): // m <public keys> n OP_CHECKMULTISIG (see multisig.go)
+        return "p2ms"
+    }
+
+    // Non-Standard (if the script type hasn't been identified then it remains as an unknown "non-standard" script)
+    return "non-standard"
+}
+
+// addressPrefixes are the version bytes of the base58 addresses and the human readable part of the bech32 addresses for a network
+//
+//   main                  1address      3address  bc1address
+//   test/testnet4/signet  (m/n)address  2address  tb1address
+//   regtest               (m/n)address  2address  bcrt1address
+type addressPrefixes struct {
+    pubKeyHash byte
+    scriptHash byte
+    hrp        string
+}
+
+// networkPrefixes gets the address prefixes for a network (main, test, testnet4, signet or regtest - empty is main)
+func networkPrefixes(network string) addressPrefixes {
+    switch network {
+    case "", "main":
+        return addressPrefixes{0x00, 0x05, "bc"}
+    case "regtest":
+        return addressPrefixes{0x6f, 0xc4, "bcrt"}
+    }
+    return addressPrefixes{0x6f, 0xc4, "tb"} // the test networks all use the same prefixes
+}
+
+// Address gets the address for a script (if it has one).
+func Address(scriptType string, script []byte, network string, p2pkaddresses bool) string {
+
+    var address string
+    prefixes := networkPrefixes(network)
+
+    switch scriptType {
+
+    case "p2pkh":
+        address = keys.Hash160ToAddress(script, []byte{prefixes.pubKeyHash})
+
+    case "p2sh":
+        address = keys.Hash160ToAddress(script, []byte{prefixes.scriptHash})
+
+    case "p2pk":
+        // P2PK scripts technically don't have addresses, but sometimes it's useful to convert the public key to one anyway
+        if p2pkaddresses {
+            address = keys.PublicKeyToAddress(script, []byte{prefixes.pubKeyHash})
+        }
+
+    case "p2wpkh", "p2wsh", "p2tr":
+        // script  = 0014700d1635c4399d35061c1dabcc4632c30fedadd6
+        // version = [0]
+        // program =      [112 13 22 53 196 57 157 53 6 28 29 171 204 70 50 195 15 237 173 214]
+        version := 0
+        if script[0] != 0 {
+            version = int(script[0]) - 0x50 // OP_1 (0x51) = segwit v1 = taproot
+        }
+
+        // encode in to an array on the stack, so the only thing allocated is the string
+        var buffer [90]byte
+        encoded, err := bech32.AppendSegwitAddr(buffer[:0], prefixes.hrp, version, script[2:])
+        if err == nil {
+            address = string(encoded)
+        }
+    }
+
+    return address
+}
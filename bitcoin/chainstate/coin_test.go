@@ -0,0 +1,37 @@
+package chainstate
+
+import "encoding/hex"
+import "testing"
+
+// TestAddressNetworks checks the address prefixes for each network (the hash160 and segwit addresses are the BIP173 examples)
+func TestAddressNetworks(t *testing.T) {
+    hash160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+    p2wpkh, _ := hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+    p2tr, _ := hex.DecodeString("512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+
+    tests := []struct {
+        network    string
+        scriptType string
+        script     []byte
+        address    string
+    }{
+        {"", "p2pkh", hash160, "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+        {"main", "p2sh", hash160, "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw"},
+        {"main", "p2wpkh", p2wpkh, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+        {"main", "p2tr", p2tr, "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"},
+        {"test", "p2pkh", hash160, "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r"},
+        {"test", "p2sh", hash160, "2N3vVYSK5XRgVSGWy21PnsRmBUywSQNdCsf"},
+        {"test", "p2wpkh", p2wpkh, "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"},
+        {"testnet4", "p2wpkh", p2wpkh, "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"},
+        {"signet", "p2tr", p2tr, "tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47zagq"},
+        {"regtest", "p2pkh", hash160, "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r"},
+        {"regtest", "p2sh", hash160, "2N3vVYSK5XRgVSGWy21PnsRmBUywSQNdCsf"},
+        {"regtest", "p2wpkh", p2wpkh, "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080"},
+        {"regtest", "p2tr", p2tr, "bcrt1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqc8gma6"},
+    }
+    for _, test := range tests {
+        if address := Address(test.scriptType, test.script, test.network, false); address != test.address {
+            t.Errorf("%s %s: got %s, want %s", test.network, test.scriptType, address, test.address)
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/bech32" // segwit bitcoin addresses
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/crypto" // checksums and hash160
+import "github.com/akamensky/base58"
+import "bytes"
+import "fmt"
+import "strings"
+
+// AddressSet matches coins that are locked to any of a set of addresses.
+//
+// Each address is decoded in to the compressed form of the script that's stored in the chainstate, so coins can be matched without encoding their addresses:
+//
+//   1address  -> nsize 0 + hash160
+//   3address  -> nsize 1 + hash160
+//   bc1q...   -> complete script (0014<20 bytes> or 0020<32 bytes>)
+//   bc1p...   -> complete script (5120<32 bytes>)
+type AddressSet struct {
+    P2PK    bool                // also match P2PK public keys that hash to a P2PKH address in the set
+    scripts map[string]struct{} // scriptKey -> present
+}
+
+// NewAddressSet returns an empty set of addresses.
+func NewAddressSet() *AddressSet {
+    return &AddressSet{scripts: map[string]struct{}{}}
+}
+
+// Len returns the number of different scripts in the set.
+func (s *AddressSet) Len() int {
+    return len(s.scripts)
+}
+
+// scriptKey identifies a script in its compressed form (nsize 0 and 1 only store a hash160, so the nsize is part of the key)
+func scriptKey(nsize int64, script []byte) string {
+    switch nsize {
+    case 0:
+        return "\x00" + string(script)
+    case 1:
+        return "\x01" + string(script)
+    }
+    return "\xff" + string(script) // complete script
+}
+
+// Add decodes an address (base58 or bech32/bech32m, mainnet, testnet or regtest) and adds it to the set.
+func (s *AddressSet) Add(address string) error {
+    nsize, script, err := AddressScript(address)
+    if err != nil {
+        return err
+    }
+    s.scripts[scriptKey(nsize, script)] = struct{}{}
+    return nil
+}
+
+// Match reports whether a coin (with its nsize and script decoded) is locked to one of the addresses in the set.
+func (s *AddressSet) Match(coin *Coin) bool {
+    if coin.NSize > 1 && coin.NSize < 6 { // P2PK
+        if !s.P2PK {
+            return false
+        }
+        _, ok := s.scripts[scriptKey(0, crypto.Hash160(coin.Script))]
+        return ok
+    }
+    _, ok := s.scripts[scriptKey(coin.NSize, coin.Script)]
+    return ok
+}
+
+// AddressScript decodes an address in to the nsize and script it would have in the chainstate (a hash160 for nsize 0 and 1, otherwise the complete script).
+func AddressScript(address string) (int64, []byte, error) {
+
+    // Bech32 (segwit) addresses
+    lower := strings.ToLower(address)
+    for _, hrp := range []string{"bc", "tb", "bcrt"} {
+        if !strings.HasPrefix(lower, hrp + "1") {
+            continue
+        }
+        if address != lower && address != strings.ToUpper(address) { // bech32 can be all upper case (e.g. for QR codes), but not a mix
+            return 0, nil, fmt.Errorf("invalid address %s: mixed case", address)
+        }
+        version, program, err := bech32.SegwitAddrDecode(hrp, lower)
+        if err != nil {
+            return 0, nil, fmt.Errorf("invalid address %s: %v", address, err)
+        }
+
+        // script = version program-length program (version 0 = OP_0, version 1-16 = OP_1-OP_16)
+        script := []byte{0x00}
+        if version > 0 {
+            script[0] = byte(0x50 + version)
+        }
+        script = append(script, byte(len(program)))
+        for _, v := range program {
+            script = append(script, byte(v))
+        }
+        return int64(len(script) + 6), script, nil
+    }
+
+    // Base58 addresses
+    //
+    //   [prefix] [hash160 (20 bytes)] [checksum (4 bytes)]
+    decoded, err := base58.Decode(address)
+    if err != nil || len(decoded) != 25 {
+        return 0, nil, fmt.Errorf("invalid address %s", address)
+    }
+    if !bytes.Equal(crypto.Checksum(decoded[:21]), decoded[21:]) {
+        return 0, nil, fmt.Errorf("invalid address %s: bad checksum", address)
+    }
+    switch decoded[0] {
+    case 0x00, 0x6f: // P2PKH (1address, m/naddress)
+        return 0, decoded[1:21], nil
+    case 0x05, 0xc4: // P2SH (3address, 2address)
+        return 1, decoded[1:21], nil
+    }
+    return 0, nil, fmt.Errorf("invalid address %s: unknown prefix %x", address, decoded[0])
+}
@@ -0,0 +1,44 @@
+package chainstate
+
+import "encoding/hex"
+import "strings"
+import "testing"
+
+func TestAddressScript(t *testing.T) {
+    tests := []struct {
+        address string
+        nsize   int64
+        script  string
+        err     string // part of the error message (empty if it's valid)
+    }{
+        {"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", 0, "751e76e8199196d454941c45d1b3a323f1433bd6", ""},
+        {"3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw", 1, "751e76e8199196d454941c45d1b3a323f1433bd6", ""},
+        {"mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r", 0, "751e76e8199196d454941c45d1b3a323f1433bd6", ""},
+        {"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", 28, "0014751e76e8199196d454941c45d1b3a323f1433bd6", ""},
+        {"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", 28, "0014751e76e8199196d454941c45d1b3a323f1433bd6", ""}, // all upper case is fine
+        {"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", 28, "0014751e76e8199196d454941c45d1b3a323f1433bd6", ""},
+        {"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", 40, "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", ""},
+        {"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kV8f3t4", 0, "", "mixed case"},
+        {"Bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", 0, "", "mixed case"},
+        {"tb1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KXPJZSX", 0, "", "mixed case"},
+        {"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", 0, "", "invalid address"},
+        {"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMJ", 0, "", "bad checksum"},
+        {"hello", 0, "", "invalid address"},
+    }
+    for _, test := range tests {
+        nsize, script, err := AddressScript(test.address)
+        if test.err != "" {
+            if err == nil || !strings.Contains(err.Error(), test.err) {
+                t.Errorf("%s: got %v, want %q", test.address, err, test.err)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", test.address, err)
+            continue
+        }
+        if nsize != test.nsize || hex.EncodeToString(script) != test.script {
+            t.Errorf("%s: got nsize %d script %x, want nsize %d script %s", test.address, nsize, script, test.nsize, test.script)
+        }
+    }
+}
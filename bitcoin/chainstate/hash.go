@@ -0,0 +1,118 @@
+package chainstate
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/binary"
+import "encoding/hex"
+import "hash"
+
+// TxOutSetHash computes the hash of a utxo set the same way as Bitcoin Core's `gettxoutsetinfo hash_serialized_3`.
+//
+// Every coin is serialized and written to one long sha256d stream:
+//
+//   [txid (32 bytes, little-endian)] [vout (uint32)] [height*2+coinbase (uint32)] [amount (int64)] [scriptPubKey length (compact size)] [scriptPubKey]
+//
+// The coins have to be added in the same order as they are in the chainstate (which is the order the Iterator returns them in), so that the outputs of each transaction come one after another.
+//
+// Bitcoin Core hashes the outputs of each transaction in order of vout, which isn't quite the order they're in the chainstate. The vout in the key is a varint128, and the bytes of those don't sort the same as the numbers for a transaction with more than 16512 outputs:
+//
+//   chainstate  255 (80 7f), 16512 (80 80 00), 256 (81 00)
+//   hashed      255, 256, 16512
+//
+// So the outputs of the current transaction are held back and sorted by vout before they're hashed.
+type TxOutSetHash struct {
+    TxOuts      int64 // number of coins added
+    TotalAmount int64 // total amount of the coins in satoshis
+
+    sha     hash.Hash    // first round of sha256
+    txid    []byte       // transaction the held back outputs are from
+    buf     []byte       // serialized outputs of the transaction
+    outputs []hashOutput // where each output is in buf
+}
+
+// hashOutput is a serialized output waiting to be hashed
+type hashOutput struct {
+    vout       int64
+    start, end int // position in TxOutSetHash.buf
+}
+
+// NewTxOutSetHash returns an empty TxOutSetHash.
+func NewTxOutSetHash() *TxOutSetHash {
+    return &TxOutSetHash{sha: sha256.New()}
+}
+
+// Add serializes a coin in to the hash. The coin needs its value decoded (the address isn't needed).
+func (h *TxOutSetHash) Add(coin *Coin) {
+    if len(h.outputs) > 0 && !bytes.Equal(coin.TxID, h.txid) {
+        h.flush()
+    }
+    h.txid = append(h.txid[:0], coin.TxID...)
+    start := len(h.buf)
+    h.buf = AppendTxOut(h.buf, coin)
+    h.outputs = append(h.outputs, hashOutput{vout: coin.Vout, start: start, end: len(h.buf)})
+    h.TxOuts++
+    h.TotalAmount += coin.Amount
+}
+
+// flush hashes the held back outputs in order of vout
+func (h *TxOutSetHash) flush() {
+    // insertion sort (there's usually only one output, and they're nearly always in order already)
+    for i := 1; i < len(h.outputs); i++ {
+        for j := i; j > 0 && h.outputs[j].vout < h.outputs[j-1].vout; j-- {
+            h.outputs[j], h.outputs[j-1] = h.outputs[j-1], h.outputs[j]
+        }
+    }
+    for _, output := range h.outputs {
+        h.sha.Write(h.buf[output.start:output.end])
+    }
+    h.buf, h.outputs = h.buf[:0], h.outputs[:0]
+}
+
+// Sum returns the hash in the byte order it's displayed in (reversed, like txids). It should be called once all the coins have been added.
+func (h *TxOutSetHash) Sum() []byte {
+    h.flush()
+    first := h.sha.Sum(nil)
+    second := sha256.Sum256(first)
+    return reverseBytes(second[:])
+}
+
+// String returns the hash as hex (as shown by bitcoin-cli).
+func (h *TxOutSetHash) String() string {
+    return hex.EncodeToString(h.Sum())
+}
+
+// AppendTxOut appends a coin serialized as an outpoint and a txout, the same as Bitcoin Core's TxOutSer (what gets hashed for hash_serialized_3 and muhash).
+func AppendTxOut(b []byte, coin *Coin) []byte {
+
+    // outpoint
+    for i := len(coin.TxID) - 1; i >= 0; i-- { // back to little-endian
+        b = append(b, coin.TxID[i])
+    }
+    b = binary.LittleEndian.AppendUint32(b, uint32(coin.Vout))
+
+    // height and coinbase
+    code := uint32(coin.Height) << 1
+    if coin.Coinbase {
+        code |= 1
+    }
+    b = binary.LittleEndian.AppendUint32(b, code)
+
+    // txout
+    b = binary.LittleEndian.AppendUint64(b, uint64(coin.Amount))
+    spk := ScriptPubKey(coin.NSize, coin.Script)
+    b = appendCompactSize(b, uint64(len(spk)))
+    return append(b, spk...)
+}
+
+// appendCompactSize appends a length the way Bitcoin serializes them (1, 3, 5 or 9 bytes)
+func appendCompactSize(b []byte, n uint64) []byte {
+    switch {
+    case n < 0xfd:
+        return append(b, byte(n))
+    case n <= 0xffff:
+        return binary.LittleEndian.AppendUint16(append(b, 0xfd), uint16(n))
+    case n <= 0xffffffff:
+        return binary.LittleEndian.AppendUint32(append(b, 0xfe), uint32(n))
+    }
+    return binary.LittleEndian.AppendUint64(append(b, 0xff), n)
+}
@@ -0,0 +1,88 @@
+package chainstate
+
+import "crypto/sha256"
+import "encoding/hex"
+import "testing"
+
+// Coins used by the hash tests (the expected serializations are Bitcoin Core's TxOutSer)
+var (
+    genesisTxID, _   = hex.DecodeString("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+    genesisPubKey, _ = hex.DecodeString("04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f")
+    otherTxID, _     = hex.DecodeString("0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098")
+    testHash160, _   = hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+
+    genesisCoin = &Coin{TxID: genesisTxID, Vout: 0, Height: 0, Coinbase: true, Amount: 5000000000, NSize: 5, Script: genesisPubKey}
+    p2pkhCoin   = &Coin{TxID: otherTxID, Vout: 1, Height: 840000, Amount: 123456, NSize: 0, Script: testHash160}
+    bigCoin     = &Coin{TxID: otherTxID, Vout: 2, Height: 840000, Amount: 0, NSize: 6 + 254, Script: append([]byte{0x6a, 0x4c, 251}, make([]byte, 251)...)} // 254 byte script (3 byte compact size)
+)
+
+func TestAppendTxOut(t *testing.T) {
+    tests := []struct {
+        coin *Coin
+        want string
+    }{
+        //         txid (little-endian)                                           vout     height*2+coinbase amount        script
+        {genesisCoin, "3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a" + "00000000" + "01000000" + "00f2052a01000000" + "43" + "41" + hex.EncodeToString(genesisPubKey) + "ac"},
+        {p2pkhCoin, "982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e" + "01000000" + "80a21900" + "40e2010000000000" + "19" + "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac"},
+        {bigCoin, "982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e" + "02000000" + "80a21900" + "0000000000000000" + "fdfe00" + "6a4cfb" + hex.EncodeToString(make([]byte, 251))},
+    }
+    for _, test := range tests {
+        if got := hex.EncodeToString(AppendTxOut(nil, test.coin)); got != test.want {
+            t.Errorf("vout %d:\n got %s\nwant %s", test.coin.Vout, got, test.want)
+        }
+    }
+}
+
+func TestTxOutSetHash(t *testing.T) {
+    tests := []struct {
+        coins []*Coin
+        want  string
+    }{
+        {nil, "56944c5d3f98413ef45cf54545538103cc9f298e0575820ad3591376e2e0f65d"}, // sha256d of nothing (an empty utxo set, like regtest at height 0)
+        {[]*Coin{genesisCoin}, "f0c6c1cd61e8808ab88376cf2d15c7a09019697a9558fdee8ab09669e5bb47e1"},
+        {[]*Coin{genesisCoin, p2pkhCoin, bigCoin}, "3cfadc57a98f29d86d17cc85f53cb1a63d921826e1c7eaa186fd8863ed9b849a"},
+    }
+    for _, test := range tests {
+        h := NewTxOutSetHash()
+        total := int64(0)
+        for _, coin := range test.coins {
+            h.Add(coin)
+            total += coin.Amount
+        }
+        if got := h.String(); got != test.want {
+            t.Errorf("%d coins: got %s, want %s", len(test.coins), got, test.want)
+        }
+        if h.TxOuts != int64(len(test.coins)) || h.TotalAmount != total {
+            t.Errorf("%d coins: counted %d coins and %d satoshis, want %d", len(test.coins), h.TxOuts, h.TotalAmount, total)
+        }
+    }
+}
+
+// TestTxOutSetHashVoutOrder adds the outputs of a transaction in chainstate order (255, 16512, 256), which bitcoin core hashes in order of vout (255, 256, 16512)
+func TestTxOutSetHashVoutOrder(t *testing.T) {
+    coin := func(txid []byte, vout int64) *Coin {
+        return &Coin{TxID: txid, Vout: vout, Height: 840000, Amount: 1000 + vout, NSize: 0, Script: testHash160}
+    }
+    added := []*Coin{coin(genesisTxID, 0), coin(otherTxID, 255), coin(otherTxID, 16512), coin(otherTxID, 256), coin(genesisPubKey[1:33], 1)}
+    hashed := []*Coin{added[0], added[1], added[3], added[2], added[4]}
+
+    // sha256d of the outputs serialized one after another
+    var serialized []byte
+    for _, c := range hashed {
+        serialized = AppendTxOut(serialized, c)
+    }
+    first := sha256.Sum256(serialized)
+    second := sha256.Sum256(first[:])
+    want := hex.EncodeToString(reverseBytes(second[:]))
+
+    h := NewTxOutSetHash()
+    for _, c := range added {
+        h.Add(c)
+    }
+    if got := h.String(); got != want {
+        t.Errorf("got %s, want %s (outputs hashed in order of vout)", got, want)
+    }
+    if got := h.String(); got != want {
+        t.Errorf("second call to String: got %s, want %s", got, want)
+    }
+}
@@ -0,0 +1,248 @@
+package chainstate
+
+import "github.com/syndtr/goleveldb/leveldb"          // chainstate database
+import "github.com/syndtr/goleveldb/leveldb/iterator" // leveldb iterator interface
+import "github.com/syndtr/goleveldb/leveldb/opt"      // set no compression when opening leveldb
+import "github.com/syndtr/goleveldb/leveldb/util"     // key prefix ranges
+import "errors"
+import "fmt"
+
+// obfuscateKeyKey is where the obfuscateKey is stored in the chainstate (0x0e = size of the string that follows)
+var obfuscateKeyKey = []byte("\x0e\x00obfuscate_key")
+
+// bestBlockKey is where the hash of the block the coins are up to is stored
+var bestBlockKey = []byte{66} // 66 = 0x42 = B
+
+// headBlocksKey is only there while bitcoin core is writing coins to the database (it's removed when the write is finished)
+var headBlocksKey = []byte{72} // 72 = 0x48 = H
+
+// ErrIncompleteFlush is returned when bitcoin core stopped part way through writing coins to the chainstate, so the coins aren't all from the same block.
+var ErrIncompleteFlush = errors.New("chainstate: incomplete flush")
+
+// Metadata is what the chainstate stores besides the coins.
+type Metadata struct {
+    BestBlock  []byte   // hash of the block the coins are up to (big-endian), nil if there isn't one
+    HeadBlocks [][]byte // [new tip, old tip] while a flush is being written, otherwise empty
+    Legacy     bool     // coins are stored per transaction (bitcoin core before 0.15)
+}
+
+// coinPrefix is the first byte of every utxo key
+var coinPrefix = []byte{67} // 67 = 0x43 = C = "utxo"
+
+// Iterator steps through every coin in a chainstate database.
+//
+//    it, err := chainstate.Open("~/.bitcoin/chainstate/", &chainstate.Options{})
+//    defer it.Close()
+//    for it.Next() {
+//        coin := it.Coin()
+//    }
+//    err = it.Err()
+type Iterator struct {
+    Metadata Metadata
+
+    db           *leveldb.DB       // nil if the database wasn't opened by this iterator
+    iter         iterator.Iterator // leveldb iterator over the coin keys
+    obfuscateKey []byte            // key used to deobfuscate values (without the leading size byte)
+    options      Options
+    coin         Coin     // current coin
+    txid         [32]byte // buffers for the current coin (reused for every coin, which is why a coin is only valid until the next call to Next)
+    value        []byte
+    pending      []Coin // legacy: outputs of the current transaction that haven't been returned yet
+    err          error
+}
+
+// Open opens the chainstate LevelDB in a folder and returns an iterator over its coins. Close the iterator to close the database.
+func Open(folder string, options *Options) (*Iterator, error) {
+
+    db, err := openDB(folder)
+    if err != nil {
+        return nil, err
+    }
+
+    it, err := NewIterator(db, options)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    it.db = db // closed with the iterator
+
+    return it, nil
+}
+
+// openDB opens a chainstate leveldb
+func openDB(folder string) (*leveldb.DB, error) {
+
+    // open leveldb without compression to avoid corrupting the database for bitcoin
+    // https://bitcoin.stackexchange.com/questions/52257/chainstate-leveldb-corruption-after-reading-from-the-database
+    // https://github.com/syndtr/goleveldb/issues/61
+    return leveldb.OpenFile(folder, &opt.Options{Compression: opt.NoCompression})
+}
+
+// NewIterator returns an iterator over the coins in an already opened chainstate database. Closing the iterator does not close the database.
+func NewIterator(db *leveldb.DB, options *Options) (*Iterator, error) {
+
+    it := &Iterator{}
+    if options != nil {
+        it.options = *options
+    }
+
+    // Obfuscate key, best block, etc.
+    obfuscateKey, metadata, err := readMetadata(db)
+    if err != nil {
+        return nil, err
+    }
+    it.obfuscateKey, it.Metadata = obfuscateKey, metadata
+
+    // Only iterate over the utxo entries
+    it.iter = db.NewIterator(util.BytesPrefix(metadata.coinPrefix()), nil)
+
+    return it, nil
+}
+
+// readMetadata gets the obfuscateKey and everything else that's stored in the chainstate besides the coins. It returns an error if the coins can't be read as they are.
+func readMetadata(db *leveldb.DB) ([]byte, Metadata, error) {
+
+    var metadata Metadata
+
+    // Get the obfuscateKey (older chainstates don't have one, so their values aren't obfuscated)
+    var obfuscateKey []byte
+    value, err := db.Get(obfuscateKeyKey, nil)
+    if err != nil && err != leveldb.ErrNotFound {
+        return nil, metadata, err
+    }
+    if len(value) > 0 {
+        obfuscateKey = value[1:] // ignore the first byte, as that just tells you the size of the obfuscateKey
+    }
+
+    // Best block and head blocks (the values are obfuscated like every other value)
+    //
+    //   B = [block hash]
+    //   H = [count (compact size)] [new tip block hash] [old tip block hash] <- written before a flush and removed after it
+    bestBlock, err := db.Get(bestBlockKey, nil)
+    if err != nil && err != leveldb.ErrNotFound {
+        return nil, metadata, err
+    }
+    if len(bestBlock) == 32 {
+        metadata.BestBlock = reverseBytes(Deobfuscate(bestBlock, obfuscateKey))
+    }
+    headBlocks, err := db.Get(headBlocksKey, nil)
+    if err != nil && err != leveldb.ErrNotFound {
+        return nil, metadata, err
+    }
+    if len(headBlocks) > 0 {
+        headBlocks = Deobfuscate(headBlocks, obfuscateKey)
+        count := int(headBlocks[0])
+        if count >= 0xfd || len(headBlocks) != 1+count*32 {
+            return nil, metadata, fmt.Errorf("%w: head blocks %x", ErrMalformed, headBlocks)
+        }
+        for i := 0; i < count; i++ {
+            metadata.HeadBlocks = append(metadata.HeadBlocks, reverseBytes(headBlocks[1+i*32:1+(i+1)*32]))
+        }
+    }
+    if len(metadata.HeadBlocks) > 0 {
+        err := fmt.Errorf("%w: bitcoin core was part way through writing the coins for block %x", ErrIncompleteFlush, metadata.HeadBlocks[0])
+        if len(metadata.HeadBlocks) > 1 {
+            err = fmt.Errorf("%w (from block %x)", err, metadata.HeadBlocks[1])
+        }
+        return nil, metadata, fmt.Errorf("%w. Start bitcoind to let it finish, then stop it cleanly before dumping", err)
+    }
+
+    // Chainstates from before bitcoin core 0.15 store the coins for each transaction together under a different prefix
+    if hasPrefix(db, legacyCoinPrefix) {
+        if hasPrefix(db, coinPrefix) {
+            return nil, metadata, fmt.Errorf("%w. Start bitcoind (0.15 or later) to let it finish, then stop it cleanly before dumping", ErrPartialUpgrade)
+        }
+        metadata.Legacy = true
+    }
+
+    return obfuscateKey, metadata, nil
+}
+
+// coinPrefix is the prefix of the keys the coins are stored under (legacy chainstates store them per transaction under a different prefix)
+func (m *Metadata) coinPrefix() []byte {
+    if m.Legacy {
+        return legacyCoinPrefix
+    }
+    return coinPrefix
+}
+
+// decodeOptions are used for decoding values in the iterators (the address is encoded after filtering)
+var decodeOptions = Options{NoAddress: true}
+
+// hasPrefix reports whether there are any keys in the database that start with prefix
+func hasPrefix(db *leveldb.DB, prefix []byte) bool {
+    iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+    defer iter.Release()
+    return iter.First()
+}
+
+// Next moves to the next coin. It returns false when there are no more coins or an error occurred.
+func (it *Iterator) Next() bool {
+
+    if it.err != nil {
+        return false
+    }
+
+    if it.Metadata.Legacy {
+        return it.nextLegacy()
+    }
+
+    for it.iter.Next() {
+
+        key := it.iter.Key()
+        value := it.iter.Value()
+
+        it.coin = Coin{TxID: it.txid[:]}
+
+        // Key
+        vout, err := decodeKey(it.coin.TxID, key)
+        if err != nil {
+            it.err = fmt.Errorf("%w: key %x", err, key)
+            return false
+        }
+        it.coin.Vout = vout
+
+        // Value - only deobfuscate and decode the value if something is needed from it (improves speed if you just want the txid:vout)
+        if !it.options.KeyOnly || it.options.Filter != nil {
+            it.value = AppendDeobfuscated(it.value[:0], value, it.obfuscateKey)
+            if err := DecodeValue(&it.coin, it.value, &decodeOptions); err != nil { // address is encoded after filtering
+                it.err = fmt.Errorf("%w: key %x", err, key)
+                return false
+            }
+        }
+
+        // Skip coins that don't match the filter
+        if it.options.Filter != nil && !it.options.Filter(&it.coin) {
+            continue
+        }
+
+        // Address (and multisig details)
+        it.options.encode(&it.coin)
+
+        return true
+    }
+
+    return false
+}
+
+// Coin returns the current coin. It is only valid until the next call to Next.
+func (it *Iterator) Coin() *Coin {
+    return &it.coin
+}
+
+// Err returns the first error encountered while iterating.
+func (it *Iterator) Err() error {
+    if it.err != nil {
+        return it.err
+    }
+    return it.iter.Error()
+}
+
+// Close releases the iterator (and closes the database if it was opened with Open).
+func (it *Iterator) Close() error {
+    it.iter.Release()
+    if it.db != nil {
+        return it.db.Close()
+    }
+    return nil
+}
@@ -0,0 +1,160 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128
+import "errors"
+import "fmt"
+
+// Legacy chainstate (bitcoin core before 0.15)
+//
+// Older versions of bitcoin core stored all the unspent outputs of a transaction together in one record, instead of one record per output:
+//
+//   key:   [c] [txid (little-endian)]
+//   value: [version (varint)] [code (varint)] [spentness bitmask] [txout] [txout] ... [height (varint)]
+//
+// The code says whether the transaction is a coinbase and which of the first two outputs are unspent, and the bitmask says which of the rest are unspent. Only the unspent outputs are stored, and each one is compressed the same way as in the newer format ([amount (varint)] [nsize (varint)] [script]).
+//
+// bitcoin core 0.15 converts the database to the newer format the first time it starts, so these only turn up in chainstates copied from older nodes.
+
+// legacyCoinPrefix is the first byte of every transaction key in a legacy chainstate
+var legacyCoinPrefix = []byte{99} // 99 = 0x63 = c
+
+// ErrPartialUpgrade is returned for a chainstate that has records in both the legacy and the current format, which happens when bitcoin core was stopped part way through upgrading it.
+var ErrPartialUpgrade = errors.New("chainstate: partially upgraded from the pre-0.15 format")
+
+// DecodeLegacyKey gets the txid from a transaction's key in a legacy chainstate.
+func DecodeLegacyKey(key []byte) ([]byte, error) {
+    txid := make([]byte, 32)
+    if err := decodeLegacyKey(txid, key); err != nil {
+        return nil, err
+    }
+    return txid, nil
+}
+
+// decodeLegacyKey is DecodeLegacyKey with the txid written to a 32 byte slice (so the iterators can reuse one).
+func decodeLegacyKey(txid []byte, key []byte) error {
+    if len(key) != 33 || key[0] != 99 { // 99 = 0x63 = c
+        return ErrMalformed
+    }
+    for i := 0; i < 32; i++ {
+        txid[i] = key[32-i] // reverse byte order
+    }
+    return nil
+}
+
+// DecodeLegacyValue appends the unspent outputs of a transaction (in order of vout) to coins, from the transaction's deobfuscated value in a legacy chainstate.
+func DecodeLegacyValue(coins []Coin, txid []byte, value []byte, options *Options) ([]Coin, error) {
+
+    offset := 0
+
+    // Version (not needed)
+    _, bytesRead := btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 {
+        return coins, ErrMalformed
+    }
+    offset += bytesRead
+
+    // Code
+    //
+    //   bit 0    = coinbase
+    //   bit 1    = vout 0 is unspent
+    //   bit 2    = vout 1 is unspent
+    //   bits 3.. = number of non-zero bytes in the bitmask (minus one if neither vout 0 or 1 are unspent, as there has to be at least one unspent output)
+    varint, bytesRead := btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 {
+        return coins, ErrMalformed
+    }
+    offset += bytesRead
+    code := btcleveldb.Varint128Decode(varint)
+    coinbase := code & 1 == 1
+    unspent := []bool{code & 2 != 0, code & 4 != 0}
+    maskBytes := code >> 3
+    if code & 6 == 0 {
+        maskBytes++
+    }
+
+    // Spentness bitmask - one bit for each output from vout 2 onwards (zero bytes don't count towards the number of bytes in the code)
+    for maskBytes > 0 {
+        if offset >= len(value) {
+            return coins, ErrMalformed
+        }
+        mask := value[offset]
+        offset++
+        for bit := uint(0); bit < 8; bit++ {
+            unspent = append(unspent, mask & (1 << bit) != 0)
+        }
+        if mask != 0 {
+            maskBytes--
+        }
+    }
+
+    // Unspent outputs
+    start := len(coins)
+    for vout, ok := range unspent {
+        if !ok {
+            continue
+        }
+        coin := Coin{TxID: txid, Vout: int64(vout), Coinbase: coinbase}
+        end, err := decodeTxOut(&coin, value, offset)
+        if err != nil {
+            return coins[:start], err
+        }
+        offset = end
+        coins = append(coins, coin)
+    }
+
+    // Height (goes at the end because it's the same for every output)
+    varint, bytesRead = btcleveldb.Varint128Read(value, offset)
+    if bytesRead == 0 || offset+bytesRead != len(value) {
+        return coins[:start], ErrMalformed
+    }
+    height := btcleveldb.Varint128Decode(varint)
+
+    for i := start; i < len(coins); i++ {
+        coins[i].Height = height
+        options.encode(&coins[i])
+    }
+
+    return coins, nil
+}
+
+// nextLegacy is Next for a legacy chainstate. Each record holds all the unspent outputs of a transaction, so they're decoded together and then returned one at a time.
+func (it *Iterator) nextLegacy() bool {
+
+    for {
+
+        // Decode the next transaction once all of the outputs from the last one have been returned
+        for len(it.pending) == 0 {
+            if !it.iter.Next() {
+                return false
+            }
+
+            key := it.iter.Key()
+            if err := decodeLegacyKey(it.txid[:], key); err != nil { // shared by all the outputs (they're all returned before the next transaction is decoded)
+                it.err = fmt.Errorf("%w: key %x", err, key)
+                return false
+            }
+
+            // The value always has to be decoded (even for KeyOnly) to find out which outputs are unspent
+            var err error
+            it.value = AppendDeobfuscated(it.value[:0], it.iter.Value(), it.obfuscateKey)
+            it.pending, err = DecodeLegacyValue(it.pending[:0], it.txid[:], it.value, &decodeOptions) // address is encoded after filtering
+            if err != nil {
+                it.err = fmt.Errorf("%w: key %x", err, key)
+                return false
+            }
+        }
+
+        it.coin = it.pending[0]
+        it.pending = it.pending[1:]
+
+        // Skip coins that don't match the filter
+        if it.options.Filter != nil && !it.options.Filter(&it.coin) {
+            continue
+        }
+
+        // Address (and multisig details)
+        it.options.encode(&it.coin)
+
+        return true
+    }
+}
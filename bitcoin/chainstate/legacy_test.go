@@ -0,0 +1,97 @@
+package chainstate
+
+import "encoding/hex"
+import "errors"
+import "testing"
+
+// TestDecodeLegacyValue uses the examples from the comment in bitcoin core 0.14's coins.h, and a couple of edge cases of the code and bitmask
+func TestDecodeLegacyValue(t *testing.T) {
+    type output struct {
+        vout   int64
+        amount int64
+        script string
+    }
+    tests := []struct {
+        name     string
+        value    string
+        coinbase bool
+        height   int64
+        outputs  []output
+    }{
+        // version 1, code 4 (vout 1 unspent, no bitmask), vout 1, height 203998
+        {"core example 1", "0104835800816115944e077fe7c803cfa57f29b36bf87c1d358bb85e", false, 203998, []output{
+            {1, 60000000000, "816115944e077fe7c803cfa57f29b36bf87c1d35"},
+        }},
+        // version 1, code 9 (coinbase, neither vout 0 or 1 unspent, so 1+1 bitmask bytes), bitmask 0440 (vout 4 and 16), height 120891
+        {"core example 2", "0109044086ef97d5790061b01caab50f1b8e9c50a5057eb43c2d9563a4eebbd123008c988f1a4a4de2161e0f50aac7f17e7f9555caa486af3b", true, 120891, []output{
+            {4, 234925952, "61b01caab50f1b8e9c50a5057eb43c2d9563a4ee"},
+            {16, 110397, "8c988f1a4a4de2161e0f50aac7f17e7f9555caa4"},
+        }},
+        // code 10 (vout 0 unspent, 1 non-zero bitmask byte), bitmask 0001 (the zero byte doesn't count, so vout 10 is unspent), height 0
+        {"zero bitmask byte", "010a0001" + "0000" + "751e76e8199196d454941c45d1b3a323f1433bd6" + "0000" + "751e76e8199196d454941c45d1b3a323f1433bd6" + "00", false, 0, []output{
+            {0, 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+            {10, 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+        }},
+        // code 7 (coinbase, vout 0 and 1 unspent, no bitmask), height 1
+        {"vout 0 and 1", "0107" + "0000" + "751e76e8199196d454941c45d1b3a323f1433bd6" + "0000" + "751e76e8199196d454941c45d1b3a323f1433bd6" + "01", true, 1, []output{
+            {0, 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+            {1, 0, "751e76e8199196d454941c45d1b3a323f1433bd6"},
+        }},
+    }
+
+    txid := make([]byte, 32)
+    for _, test := range tests {
+        value, _ := hex.DecodeString(test.value)
+        coins, err := DecodeLegacyValue(nil, txid, value, &Options{})
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if len(coins) != len(test.outputs) {
+            t.Errorf("%s: got %d outputs, want %d", test.name, len(coins), len(test.outputs))
+            continue
+        }
+        for i, want := range test.outputs {
+            coin := coins[i]
+            if coin.Vout != want.vout || coin.Amount != want.amount || hex.EncodeToString(coin.Script) != want.script || coin.Height != test.height || coin.Coinbase != test.coinbase || coin.Type != "p2pkh" || coin.Address == "" {
+                t.Errorf("%s: output %d is vout %d, %d satoshis, script %x, height %d, coinbase %v, type %s, address %q", test.name, i, coin.Vout, coin.Amount, coin.Script, coin.Height, coin.Coinbase, coin.Type, coin.Address)
+            }
+        }
+    }
+}
+
+func TestDecodeLegacyValueMalformed(t *testing.T) {
+    tests := []struct {
+        name  string
+        value string
+    }{
+        {"empty", ""},
+        {"no code", "01"},
+        {"bitmask runs out", "0109"},
+        {"bitmask all zeros", "0109000000"},
+        {"output runs out", "010400816115944e077fe7c803cfa57f29b36bf8"},
+        {"no height", "0104835800816115944e077fe7c803cfa57f29b36bf87c1d35"},
+        {"extra bytes after the height", "0104835800816115944e077fe7c803cfa57f29b36bf87c1d358bb85e00"},
+    }
+    for _, test := range tests {
+        value, _ := hex.DecodeString(test.value)
+        coins, err := DecodeLegacyValue(nil, make([]byte, 32), value, &Options{})
+        if !errors.Is(err, ErrMalformed) || len(coins) != 0 {
+            t.Errorf("%s: got %d coins and error %v, want %v", test.name, len(coins), err, ErrMalformed)
+        }
+    }
+}
+
+func TestDecodeLegacyKey(t *testing.T) {
+    key, _ := hex.DecodeString("63" + "3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a")
+    txid, err := DecodeLegacyKey(key)
+    if err != nil || hex.EncodeToString(txid) != "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b" {
+        t.Errorf("got %x, %v", txid, err)
+    }
+    for _, bad := range []string{"", "63", "43" + hex.EncodeToString(txid), "63" + hex.EncodeToString(txid) + "00"} {
+        key, _ := hex.DecodeString(bad)
+        if _, err := DecodeLegacyKey(key); !errors.Is(err, ErrMalformed) {
+            t.Errorf("key %s: got %v, want %v", bad, err, ErrMalformed)
+        }
+    }
+}
@@ -0,0 +1,133 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/keys" // public key checks and addresses
+
+// Bare multisig (P2MS)
+//
+// A multisig locking script has the number of signatures needed (m), the public keys (n of them), the number of keys again, and then OP_CHECKMULTISIG:
+//
+//   OP_1 OP_PUSHBYTES_33 <02publickey> OP_PUSHBYTES_65 <04publickey> OP_2 OP_CHECKMULTISIG
+//   <--> <-------------------------------------------------------->  <-->
+//    m                        public keys                              n
+//
+// This is matched the same way as bitcoin core's Solver, so a script is only a p2ms if m and n are numbers from 1 to 20 (m <= n), there are exactly n keys, and each key is the right size for its prefix (33 bytes for 02/03, 65 bytes for 04/06/07). Anything else that just happens to end in OP_CHECKMULTISIG is non-standard.
+//
+// The keys aren't checked to see if they're actually points on the curve (bitcoin core doesn't either, so plenty of p2ms outputs have keys that are really data), but Multisig.Valid says which ones are.
+
+// maxMultisigKeys is the most public keys a multisig script can have
+const maxMultisigKeys = 20
+
+// Multisig is the details of a bare multisig (p2ms) locking script.
+type Multisig struct {
+    M         int      // number of signatures needed
+    PubKeys   [][]byte // public keys (n of them, pointing in to the script)
+    Valid     []bool   // whether each public key is a point on the secp256k1 curve
+    Addresses []string // p2pkh address for each public key (only with Options.MultisigAddresses)
+}
+
+// ParseMultisig gets m and the public keys from a multisig script (the complete script, which is how they're stored). The public keys are appended to pubkeys. ok is false if it isn't a multisig script.
+func ParseMultisig(pubkeys [][]byte, script []byte) (int, [][]byte, bool) {
+
+    if len(script) == 0 || script[len(script)-1] != 0xae { // OP_CHECKMULTISIG
+        return 0, pubkeys, false
+    }
+
+    // m
+    opcode, data, pc, ok := scriptOp(script, 0)
+    if !ok {
+        return 0, pubkeys, false
+    }
+    m, ok := multisigNumber(opcode, data, 1)
+    if !ok {
+        return 0, pubkeys, false
+    }
+
+    // Public keys (every push that's the right size for a public key)
+    start := len(pubkeys)
+    for pc < len(script) {
+        opcode, data, pc, ok = scriptOp(script, pc)
+        if !ok {
+            return 0, pubkeys[:start], false
+        }
+        if !publicKeySize(data) {
+            break
+        }
+        if len(pubkeys)-start == maxMultisigKeys { // too many keys for n to match
+            return 0, pubkeys[:start], false
+        }
+        pubkeys = append(pubkeys, data)
+    }
+
+    // n (has to match the number of keys, and be followed by OP_CHECKMULTISIG and nothing else)
+    n, ok := multisigNumber(opcode, data, m)
+    if !ok || n != len(pubkeys)-start || pc != len(script)-1 {
+        return 0, pubkeys[:start], false
+    }
+
+    return m, pubkeys, true
+}
+
+// isMultisig reports whether a complete script is a multisig script (without keeping the keys)
+func isMultisig(script []byte) bool {
+    var buffer [maxMultisigKeys][]byte // on the stack
+    _, _, ok := ParseMultisig(buffer[:0], script)
+    return ok
+}
+
+// multisigNumber gets m or n (min to 20), which can be OP_1 to OP_16, or a push of a number for 17 to 20 (encoded the shortest way possible, the same as bitcoin core's GetScriptNumber)
+func multisigNumber(opcode byte, data []byte, min int) (int, bool) {
+    var n int
+    switch {
+    case 0x51 <= opcode && opcode <= 0x60: // OP_1 to OP_16
+        n = int(opcode - 0x50)
+    case 0 < opcode && opcode <= 0x4b && int(opcode) == len(data) && len(data) <= 4: // push of a number (it has to be a plain push for numbers this small)
+        if len(data) == 1 && (data[0] == 0x81 || (1 <= data[0] && data[0] <= 16)) { // these should have been OP_1NEGATE or OP_1 to OP_16
+            return 0, false
+        }
+        if data[len(data)-1]&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) { // extra zero byte on the end
+            return 0, false
+        }
+        n = int(scriptNum(data))
+    default:
+        return 0, false
+    }
+    if n < min || n > maxMultisigKeys {
+        return 0, false
+    }
+    return n, true
+}
+
+// publicKeySize reports whether some data is the right size for a public key, going by its first byte (the same as bitcoin core's CPubKey::ValidSize)
+func publicKeySize(data []byte) bool {
+    if len(data) == 0 {
+        return false
+    }
+    switch data[0] {
+    case 0x02, 0x03:
+        return len(data) == 33
+    case 0x04, 0x06, 0x07:
+        return len(data) == 65
+    }
+    return false
+}
+
+// decodeMultisig gets the details of a multisig script
+func decodeMultisig(script []byte, network string, addresses bool) *Multisig {
+    m, pubkeys, ok := ParseMultisig(nil, script)
+    if !ok {
+        return nil
+    }
+
+    ms := &Multisig{M: m, PubKeys: pubkeys, Valid: make([]bool, len(pubkeys))}
+    for i, pubkey := range pubkeys {
+        ms.Valid[i] = keys.ValidPublicKey(pubkey)
+    }
+    if addresses {
+        prefix := []byte{networkPrefixes(network).pubKeyHash}
+        ms.Addresses = make([]string, len(pubkeys))
+        for i, pubkey := range pubkeys {
+            ms.Addresses[i] = keys.PublicKeyToAddress(pubkey, prefix)
+        }
+    }
+    return ms
+}
@@ -0,0 +1,105 @@
+package chainstate
+
+import "bytes"
+import "encoding/hex"
+import "reflect"
+import "strings"
+import "testing"
+
+// Public keys used by the multisig tests (the generator point, compressed and uncompressed, and a couple that aren't real keys)
+var (
+    compressedKey, _   = hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+    uncompressedKey, _ = hex.DecodeString("0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+    notOnCurveKey, _   = hex.DecodeString("02" + strings.Repeat("00", 32)) // right size, but x = 0 isn't on the curve
+    wrongPrefixKey, _  = hex.DecodeString("05" + strings.Repeat("11", 32)) // 33 bytes, but 05 isn't a public key prefix
+)
+
+// multisigScript joins opcodes and pushes of public keys in to a script
+func multisigScript(parts ...interface{}) []byte {
+    var script []byte
+    for _, part := range parts {
+        switch v := part.(type) {
+        case int: // opcode
+            script = append(script, byte(v))
+        case string: // raw hex
+            b, _ := hex.DecodeString(v)
+            script = append(script, b...)
+        case []byte: // push
+            script = append(append(script, byte(len(v))), v...)
+        }
+    }
+    return script
+}
+
+// keyPushes is n pushes of the compressed key
+func keyPushes(n int) string {
+    return strings.Repeat("21"+hex.EncodeToString(compressedKey), n)
+}
+
+func TestParseMultisig(t *testing.T) {
+    tests := []struct {
+        name   string
+        script []byte
+        m, n   int // n = 0 if it isn't a multisig
+    }{
+        {"1-of-1", multisigScript(0x51, compressedKey, 0x51, 0xae), 1, 1},
+        {"2-of-3 mixed keys", multisigScript(0x52, compressedKey, uncompressedKey, notOnCurveKey, 0x53, 0xae), 2, 3},
+        {"16-of-16", multisigScript(0x60, keyPushes(16), 0x60, 0xae), 16, 16},
+        {"17-of-20 (pushed numbers)", multisigScript("0111", keyPushes(20), "0114", 0xae), 17, 20},
+        {"m more than n", multisigScript(0x52, compressedKey, 0x51, 0xae), 0, 0},
+        {"m is 0", multisigScript(0x00, compressedKey, 0x51, 0xae), 0, 0},
+        {"n doesn't match the keys", multisigScript(0x51, compressedKey, compressedKey, 0x51, 0xae), 0, 0},
+        {"no keys", multisigScript(0x51, 0x51, 0xae), 0, 0},
+        {"21 keys", multisigScript(0x51, keyPushes(21), "0115", 0xae), 0, 0},
+        {"1 pushed instead of OP_1", multisigScript("0101", compressedKey, 0x51, 0xae), 0, 0},
+        {"17 with an extra zero byte", multisigScript("021100", keyPushes(17), "0111", 0xae), 0, 0},
+        {"wrong key prefix", multisigScript(0x51, wrongPrefixKey, 0x51, 0xae), 0, 0},
+        {"compressed key with the wrong size", multisigScript(0x51, append(compressedKey, 0), 0x51, 0xae), 0, 0},
+        {"opcode before OP_CHECKMULTISIG", multisigScript(0x51, compressedKey, 0x51, 0x61, 0xae), 0, 0},
+        {"OP_CHECKMULTISIGVERIFY", multisigScript(0x51, compressedKey, 0x51, 0xaf), 0, 0},
+        {"push runs past the end", multisigScript(0x51, "21", compressedKey[:10], 0xae), 0, 0},
+        {"empty", nil, 0, 0},
+    }
+
+    existing := [][]byte{[]byte("already here")}
+    for _, test := range tests {
+        m, pubkeys, ok := ParseMultisig(existing, test.script)
+        if ok != (test.n > 0) || m != test.m || len(pubkeys)-len(existing) != test.n {
+            t.Errorf("%s: got m %d, n %d, ok %v, want m %d, n %d", test.name, m, len(pubkeys)-len(existing), ok, test.m, test.n)
+        }
+        if !bytes.Equal(pubkeys[0], existing[0]) {
+            t.Errorf("%s: public keys already in the slice were changed", test.name)
+        }
+        if isMultisig(test.script) != (test.n > 0) {
+            t.Errorf("%s: isMultisig doesn't match", test.name)
+        }
+    }
+}
+
+func TestDecodeMultisig(t *testing.T) {
+    script := multisigScript(0x52, compressedKey, uncompressedKey, notOnCurveKey, 0x53, 0xae)
+
+    ms := decodeMultisig(script, "main", true)
+    if ms == nil || ms.M != 2 || len(ms.PubKeys) != 3 {
+        t.Fatalf("got %+v", ms)
+    }
+    if !bytes.Equal(ms.PubKeys[1], uncompressedKey) {
+        t.Errorf("second public key is %x", ms.PubKeys[1])
+    }
+    if want := []bool{true, true, false}; !reflect.DeepEqual(ms.Valid, want) {
+        t.Errorf("valid %v, want %v", ms.Valid, want)
+    }
+    if want := []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", "1EHNa6Q4Jz2uvNExL497mE43ikXhwF6kZm"}; ms.Addresses[0] != want[0] || ms.Addresses[1] != want[1] {
+        t.Errorf("addresses %v, want %v", ms.Addresses[:2], want)
+    }
+
+    if ms := decodeMultisig(script, "test", true); ms.Addresses[0] != "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r" {
+        t.Errorf("testnet address %s", ms.Addresses[0])
+    }
+    if ms := decodeMultisig(script, "main", false); ms.Addresses != nil {
+        t.Errorf("addresses without asking for them: %v", ms.Addresses)
+    }
+    if ms := decodeMultisig(multisigScript(0x52, compressedKey, 0x51, 0xae), "main", true); ms != nil {
+        t.Errorf("got %+v for a script that isn't a multisig", ms)
+    }
+}
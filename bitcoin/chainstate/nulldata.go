@@ -0,0 +1,66 @@
+package chainstate
+
+import "bytes"
+
+// Null data (OP_RETURN)
+//
+// A nulldata script is an OP_RETURN followed by nothing but pushes, which is how data gets stored in transactions:
+//
+//   OP_RETURN OP_PUSHBYTES_20 6f6d6e6900000000000000010000000005f5e100
+//             <-------------------------------------------------------> payload
+//
+// Bitcoin Core can't spend these, so it doesn't usually keep them in the chainstate at all. But they can turn up in old or unusual databases, and the scripts that are too big to store get read back as a single OP_RETURN too.
+//
+// This is matched the same way as bitcoin core's Solver (anything after the OP_RETURN has to be a push, including OP_0 to OP_16), so an OP_RETURN followed by other opcodes is non-standard.
+//
+// Some protocols can be recognised from the start of the data:
+//
+//   omni          OP_RETURN <"omni"...>       (Omni Layer class C)
+//   counterparty  OP_RETURN <"CNTRPRTY"...>   (only the old unencrypted ones - newer ones are encrypted with the txid of the first input, which isn't in the chainstate)
+//   runes         OP_RETURN OP_13 <data>...   (Runestones)
+
+// isNullData reports whether a complete script is an OP_RETURN followed by pushes
+func isNullData(script []byte) bool {
+    if len(script) == 0 || script[0] != 0x6a { // OP_RETURN
+        return false
+    }
+    for pc := 1; pc < len(script); {
+        opcode, _, next, ok := scriptOp(script, pc)
+        if !ok || opcode > 0x60 { // push that runs past the end, or not a push (OP_16 is the last one)
+            return false
+        }
+        pc = next
+    }
+    return true
+}
+
+// AppendPayload appends the data pushed by a nulldata script to b (the data from each push joined together, without OP_1 to OP_16 or the runes OP_13 tag). It returns b unchanged if the script isn't nulldata.
+func AppendPayload(b []byte, nsize int64, script []byte) []byte {
+    if nsize < 6 || len(script) > maxScriptSize || !isNullData(script) { // scripts that are too big are read back as an OP_RETURN with nothing after it
+        return b
+    }
+    for pc := 1; pc < len(script); {
+        _, data, next, _ := scriptOp(script, pc)
+        b = append(b, data...)
+        pc = next
+    }
+    return b
+}
+
+// Protocol gets the name of the protocol that put the data in a nulldata script (omni, counterparty or runes), or an empty string if it's not one we know about.
+func Protocol(nsize int64, script []byte) string {
+    if nsize < 6 || len(script) < 2 || len(script) > maxScriptSize || !isNullData(script) {
+        return ""
+    }
+    if script[1] == 0x5d { // OP_13
+        return "runes"
+    }
+    _, data, _, _ := scriptOp(script, 1) // first push
+    switch {
+    case bytes.HasPrefix(data, []byte("omni")):
+        return "omni"
+    case bytes.HasPrefix(data, []byte("CNTRPRTY")):
+        return "counterparty"
+    }
+    return ""
+}
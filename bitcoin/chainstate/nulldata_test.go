@@ -0,0 +1,67 @@
+package chainstate
+
+import "encoding/hex"
+import "strings"
+import "testing"
+
+func TestNullData(t *testing.T) {
+    omni := hex.EncodeToString([]byte("omni")) + "00000000000000010000000005f5e100"
+    counterparty := hex.EncodeToString([]byte("CNTRPRTY")) + "0000001e"
+
+    tests := []struct {
+        name     string
+        script   string
+        nulldata bool
+        payload  string
+        protocol string
+    }{
+        {"just OP_RETURN", "6a", true, "", ""},
+        {"omni", "6a14" + omni, true, omni, "omni"},
+        {"counterparty", "6a0c" + counterparty, true, counterparty, "counterparty"},
+        {"runes", "6a5d0400010203", true, "00010203", "runes"},
+        {"runes with no data", "6a5d", true, "", "runes"},
+        {"several pushes", "6a02abcd4c03010203", true, "abcd010203", ""},
+        {"OP_PUSHDATA2", "6a4d0300aabbcc", true, "aabbcc", ""},
+        {"OP_0 and OP_16", "6a0060", true, "", ""},
+        {"omni in a later push", "6a0100" + "14" + omni, true, "00" + omni, ""},
+        {"OP_13 after the first push", "6a01005d", true, "00", ""},
+        {"opcode after OP_RETURN", "6a61", false, "", ""},
+        {"push runs past the end", "6a0501", false, "", ""},
+        {"OP_RETURN not first", "006a", false, "", ""},
+        {"empty", "", false, "", ""},
+    }
+    for _, test := range tests {
+        script, _ := hex.DecodeString(test.script)
+        nsize := int64(6 + len(script))
+        if got := isNullData(script); got != test.nulldata {
+            t.Errorf("%s: isNullData %v, want %v", test.name, got, test.nulldata)
+        }
+        if got := hex.EncodeToString(AppendPayload(nil, nsize, script)); got != test.payload {
+            t.Errorf("%s: payload %s, want %s", test.name, got, test.payload)
+        }
+        if got := Protocol(nsize, script); got != test.protocol {
+            t.Errorf("%s: protocol %q, want %q", test.name, got, test.protocol)
+        }
+        if test.nulldata && ScriptType(nsize, script) != "nulldata" {
+            t.Errorf("%s: script type %s", test.name, ScriptType(nsize, script))
+        }
+    }
+}
+
+func TestNullDataCompressed(t *testing.T) {
+    // A compressed script (nsize 0 to 5) is never nulldata, even if its storage form starts with 6a
+    hash160, _ := hex.DecodeString("6a14" + strings.Repeat("00", 18))
+    if payload := AppendPayload(nil, 0, hash160); len(payload) != 0 {
+        t.Errorf("payload %x for a p2pkh", payload)
+    }
+    if protocol := Protocol(1, hash160); protocol != "" {
+        t.Errorf("protocol %q for a p2sh", protocol)
+    }
+
+    // Scripts too big to decompress are read back as a lone OP_RETURN (nulldata, but with no payload)
+    big, _ := hex.DecodeString("6a4d1027" + strings.Repeat("00", 10000))
+    nsize := int64(6 + len(big))
+    if ScriptType(nsize, big) != "nulldata" || len(AppendPayload(nil, nsize, big)) != 0 || Protocol(nsize, big) != "" {
+        t.Errorf("script over %d bytes: type %s, payload %d bytes, protocol %q", maxScriptSize, ScriptType(nsize, big), len(AppendPayload(nil, nsize, big)), Protocol(nsize, big))
+    }
+}
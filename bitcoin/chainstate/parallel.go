@@ -0,0 +1,369 @@
+package chainstate
+
+import "github.com/syndtr/goleveldb/leveldb"      // chainstate database
+import "github.com/syndtr/goleveldb/leveldb/util" // key ranges
+import "errors"
+import "fmt"
+import "sync"
+
+// Parallel scan
+//
+// Reading the chainstate on one goroutine is held up by decoding the coins (deobfuscating, decompressing public keys, and hash160/base58/bech32 for the addresses) rather than by leveldb. A ParallelIterator splits the coin keys in to ranges of txids, reads the ranges at the same time, and decodes the records on a pool of workers:
+//
+//   readers (one per range)      workers            Next
+//   C00..C3f -> batch -> \                     / -> coin
+//   C40..C7f -> batch ->  -> decode batch ->  -> coin
+//   C80..Cbf -> batch ->  ->                  -> coin
+//   Cc0..Cff -> batch -> /                     \ -> ...
+//
+// Ordered: the batches are returned range by range in the order they were read, so the coins come out in key order (the same as Iterator). The workers still decode the batches at the same time, and each reader can read a few batches ahead.
+// Unordered: the batches are returned as soon as they've been decoded, so nothing waits, but the order is different every time.
+
+// parallelBatchSize is the number of records read in to each batch
+const parallelBatchSize = 1024
+
+// parallelQueue is the number of batches each range can read ahead when the coins are returned in order
+const parallelQueue = 4
+
+// ParallelOptions control how the work gets split up.
+type ParallelOptions struct {
+    Ranges  int  // number of txid ranges to read at the same time (1 to 256)
+    Workers int  // number of goroutines decoding records
+    Ordered bool // return the coins in key order (the same as Iterator), otherwise in whatever order they're decoded
+}
+
+// parallelBatch is a batch of records read from one range, and the coins decoded from them
+type parallelBatch struct {
+    data    []byte // keys and values copied from leveldb (its buffers get reused)
+    records []int  // end of each key and value in data
+    txids   []byte // the coins' txids (32 bytes for each record)
+    coins   []Coin
+    err     error
+    done    chan struct{} // ordered: closed once the batch has been decoded
+}
+
+// add copies a record in to the batch
+func (b *parallelBatch) add(key []byte, value []byte) {
+    b.data = append(b.data, key...)
+    b.records = append(b.records, len(b.data))
+    b.data = append(b.data, value...)
+    b.records = append(b.records, len(b.data))
+}
+
+// ParallelIterator steps through every coin in a chainstate database, reading and decoding them on several goroutines. It's used the same way as Iterator.
+type ParallelIterator struct {
+    Metadata Metadata
+
+    db           *leveldb.DB // nil if the database wasn't opened by this iterator
+    obfuscateKey []byte
+    options      Options
+
+    jobs    chan *parallelBatch   // batches waiting to be decoded
+    ranges  []chan *parallelBatch // ordered: batches from each range in the order they were read
+    results chan *parallelBatch   // unordered: batches that have been decoded
+    free    chan *parallelBatch   // batches that can be reused
+    quit    chan struct{}         // closed to stop reading early
+    readers sync.WaitGroup
+    workers sync.WaitGroup
+
+    batch     *parallelBatch // batch the current coin is in
+    index     int            // index of the current coin in the batch
+    nextRange int            // ordered: range the next batch comes from
+    err       error
+    closed    bool
+}
+
+// OpenParallel opens the chainstate LevelDB in a folder and returns a parallel iterator over its coins. Close the iterator to close the database.
+func OpenParallel(folder string, options *Options, parallel ParallelOptions) (*ParallelIterator, error) {
+
+    db, err := openDB(folder)
+    if err != nil {
+        return nil, err
+    }
+
+    p, err := NewParallelIterator(db, options, parallel)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    p.db = db // closed with the iterator
+
+    return p, nil
+}
+
+// NewParallelIterator returns a parallel iterator over the coins in an already opened chainstate database. It starts reading straight away. Closing the iterator does not close the database.
+func NewParallelIterator(db *leveldb.DB, options *Options, parallel ParallelOptions) (*ParallelIterator, error) {
+
+    if parallel.Ranges < 1 || parallel.Ranges > 256 {
+        return nil, errors.New("chainstate: number of ranges has to be from 1 to 256")
+    }
+    if parallel.Workers < 1 {
+        return nil, errors.New("chainstate: need at least one worker")
+    }
+
+    p := &ParallelIterator{
+        jobs: make(chan *parallelBatch, parallel.Workers),
+        free: make(chan *parallelBatch, parallel.Ranges*parallelQueue + parallel.Workers*2),
+        quit: make(chan struct{}),
+    }
+    if options != nil {
+        p.options = *options
+    }
+
+    // Obfuscate key, best block, etc.
+    obfuscateKey, metadata, err := readMetadata(db)
+    if err != nil {
+        return nil, err
+    }
+    p.obfuscateKey, p.Metadata = obfuscateKey, metadata
+
+    // Split the keys in to ranges by the first byte of the txid
+    //
+    //   4 ranges: [C00, C40) [C40, C80) [C80, Cc0) [Cc0, D)
+    prefix := metadata.coinPrefix()
+    slices := make([]*util.Range, parallel.Ranges)
+    for i := range slices {
+        slices[i] = &util.Range{
+            Start: []byte{prefix[0], byte(i * 256 / parallel.Ranges)},
+            Limit: []byte{prefix[0], byte((i + 1) * 256 / parallel.Ranges)},
+        }
+    }
+    slices[len(slices)-1].Limit = []byte{prefix[0] + 1} // the last range goes up to the end of the prefix
+
+    if parallel.Ordered {
+        p.ranges = make([]chan *parallelBatch, parallel.Ranges)
+        for i := range p.ranges {
+            p.ranges[i] = make(chan *parallelBatch, parallelQueue)
+        }
+    } else {
+        p.results = make(chan *parallelBatch, parallel.Workers)
+    }
+
+    // Start reading and decoding
+    for i, slice := range slices {
+        p.readers.Add(1)
+        go p.read(db, i, slice)
+    }
+    for i := 0; i < parallel.Workers; i++ {
+        p.workers.Add(1)
+        go p.work()
+    }
+    go func() {
+        p.readers.Wait()
+        close(p.jobs) // the workers finish once everything that's been read has been decoded
+        p.workers.Wait()
+        if p.results != nil {
+            close(p.results)
+        }
+    }()
+
+    return p, nil
+}
+
+// newBatch gets an empty batch (reusing an old one if there is one)
+func (p *ParallelIterator) newBatch() *parallelBatch {
+    var b *parallelBatch
+    select {
+    case b = <-p.free:
+        b.data, b.records, b.coins, b.err = b.data[:0], b.records[:0], b.coins[:0], nil
+    default:
+        b = &parallelBatch{}
+    }
+    if p.ranges != nil {
+        b.done = make(chan struct{})
+    }
+    return b
+}
+
+// read reads the records in one range of keys in to batches, and hands them to the workers
+func (p *ParallelIterator) read(db *leveldb.DB, r int, slice *util.Range) {
+    defer p.readers.Done()
+    if p.ranges != nil {
+        defer close(p.ranges[r])
+    }
+
+    iter := db.NewIterator(slice, nil)
+    defer iter.Release()
+
+    batch := p.newBatch()
+    for iter.Next() {
+        batch.add(iter.Key(), iter.Value())
+        if len(batch.records) == parallelBatchSize*2 {
+            if !p.send(r, batch) {
+                return
+            }
+            batch = p.newBatch()
+        }
+    }
+    batch.err = iter.Error()
+    if len(batch.records) > 0 || batch.err != nil {
+        p.send(r, batch)
+    }
+}
+
+// send hands a batch to the workers (and puts it in the queue for its range, so it's returned in order). It returns false if the iterator has been closed.
+func (p *ParallelIterator) send(r int, batch *parallelBatch) bool {
+    select {
+    case p.jobs <- batch:
+    case <-p.quit:
+        return false
+    }
+    if p.ranges != nil {
+        select {
+        case p.ranges[r] <- batch:
+        case <-p.quit:
+            return false
+        }
+    }
+    return true
+}
+
+// work decodes batches until there are no more
+func (p *ParallelIterator) work() {
+    defer p.workers.Done()
+    for batch := range p.jobs {
+        p.decode(batch)
+        if p.results == nil {
+            close(batch.done)
+            continue
+        }
+        select {
+        case p.results <- batch:
+        case <-p.quit:
+        }
+    }
+}
+
+// decode decodes the records in a batch in to coins
+func (p *ParallelIterator) decode(batch *parallelBatch) {
+    if len(batch.txids) < parallelBatchSize*32 {
+        batch.txids = make([]byte, parallelBatchSize*32) // allocated once, as the coins point in to it
+    }
+
+    start := 0
+    for i := 0; i < len(batch.records); i += 2 {
+        key := batch.data[start:batch.records[i]]
+        value := batch.data[batch.records[i]:batch.records[i+1]]
+        start = batch.records[i+1]
+        txid := batch.txids[i/2*32 : i/2*32+32]
+
+        var err error
+        batch.coins, err = decodeRecord(batch.coins, txid, key, value, p.obfuscateKey, p.Metadata.Legacy, &p.options)
+        if err != nil {
+            batch.err = fmt.Errorf("%w: key %x", err, key) // coins up to the bad record still get returned
+            return
+        }
+    }
+}
+
+// decodeRecord appends the coins in a record to coins (one coin, or all the unspent outputs of a transaction in a legacy chainstate), leaving out the ones that don't match the filter. It does the same as Iterator.Next.
+//
+// The txid gets written to txid (32 bytes), and the value gets deobfuscated in place, so the coins point in to the batch instead of allocating.
+func decodeRecord(coins []Coin, txid []byte, key []byte, value []byte, obfuscateKey []byte, legacy bool, options *Options) ([]Coin, error) {
+    start := len(coins)
+
+    if legacy {
+        if err := decodeLegacyKey(txid, key); err != nil {
+            return coins, err
+        }
+        var err error
+        coins, err = DecodeLegacyValue(coins, txid, AppendDeobfuscated(value[:0], value, obfuscateKey), &decodeOptions) // address is encoded after filtering
+        if err != nil {
+            return coins, err
+        }
+    } else {
+        vout, err := decodeKey(txid, key)
+        if err != nil {
+            return coins, err
+        }
+        coins = append(coins, Coin{TxID: txid, Vout: vout})
+        if !options.KeyOnly || options.Filter != nil {
+            if err := DecodeValue(&coins[start], AppendDeobfuscated(value[:0], value, obfuscateKey), &decodeOptions); err != nil {
+                return coins[:start], err
+            }
+        }
+    }
+
+    // Filter, then address
+    kept := coins[:start]
+    for i := start; i < len(coins); i++ {
+        coin := &coins[i]
+        if options.Filter != nil && !options.Filter(coin) {
+            continue
+        }
+        options.encode(coin)
+        kept = append(kept, *coin)
+    }
+    return kept, nil
+}
+
+// nextBatch waits for the next decoded batch. It returns nil when there are no more.
+func (p *ParallelIterator) nextBatch() *parallelBatch {
+    if p.results != nil {
+        return <-p.results // nil once closed
+    }
+    for p.nextRange < len(p.ranges) {
+        if batch, ok := <-p.ranges[p.nextRange]; ok {
+            <-batch.done
+            return batch
+        }
+        p.nextRange++
+    }
+    return nil
+}
+
+// Next moves to the next coin. It returns false when there are no more coins or an error occurred.
+func (p *ParallelIterator) Next() bool {
+
+    for p.err == nil {
+
+        // Next coin in the current batch
+        if p.batch != nil {
+            p.index++
+            if p.index < len(p.batch.coins) {
+                return true
+            }
+            if p.batch.err != nil {
+                p.err = p.batch.err
+                return false
+            }
+            select { // reuse the batch (if there's room)
+            case p.free <- p.batch:
+            default:
+            }
+            p.batch = nil
+        }
+
+        // Next batch
+        p.batch = p.nextBatch()
+        if p.batch == nil {
+            return false
+        }
+        p.index = -1
+    }
+
+    return false
+}
+
+// Coin returns the current coin. It is only valid until the next call to Next.
+func (p *ParallelIterator) Coin() *Coin {
+    return &p.batch.coins[p.index]
+}
+
+// Err returns the first error encountered while iterating.
+func (p *ParallelIterator) Err() error {
+    return p.err
+}
+
+// Close stops reading (and closes the database if it was opened with OpenParallel).
+func (p *ParallelIterator) Close() error {
+    if !p.closed {
+        p.closed = true
+        close(p.quit)
+    }
+    p.readers.Wait() // leveldb iterators have to be released before the database is closed
+    if p.db != nil {
+        return p.db.Close()
+    }
+    return nil
+}
@@ -0,0 +1,144 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128 keys
+import "github.com/syndtr/goleveldb/leveldb"                      // chainstate database
+import "github.com/syndtr/goleveldb/leveldb/storage"              // in memory
+import "crypto/sha256"
+import "fmt"
+import "runtime"
+import "sort"
+import "strings"
+import "testing"
+import "time"
+
+// parallelTestDB writes a chainstate with coins spread over every range of txids (including vouts that aren't in numeric order in the keys) to an in-memory leveldb
+func parallelTestDB(t *testing.T) *leveldb.DB {
+    db, err := leveldb.Open(storage.NewMemStorage(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    obfuscateKey := []byte{0xb1, 0x2d, 0xce, 0xfd, 0x8f, 0x87, 0x25, 0x36}
+    if err := db.Put(obfuscateKeyKey, append([]byte{byte(len(obfuscateKey))}, obfuscateKey...), nil); err != nil {
+        t.Fatal(err)
+    }
+
+    //   key:   [C] [txid (little-endian)] [vout (varint)]
+    //   value: the coin as it's stored in the chainstate, obfuscated
+    batch := new(leveldb.Batch)
+    for i := 0; i < 6000; i++ {
+        txid := sha256.Sum256([]byte(fmt.Sprint(i)))
+        vouts := []int64{int64(i % 3)}
+        if i%1000 == 0 {
+            vouts = []int64{0, 255, 256, 16512}
+        }
+        for _, vout := range vouts {
+            coin := Coin{Vout: vout, Height: int64(i), Coinbase: i%7 == 0, Amount: int64(i) * 1000, NSize: 0, Script: txid[:20]}
+            if i%5 == 0 {
+                coin.NSize, coin.Script = 6+22, append([]byte{0x00, 0x14}, txid[:20]...) // p2wpkh
+            }
+            key := append([]byte{67}, txid[:]...) // txid is already "little-endian" here
+            key = append(key, btcleveldb.Varint128Encode(vout)...)
+            batch.Put(key, AppendDeobfuscated(nil, EncodeValue(nil, &coin), obfuscateKey))
+        }
+    }
+    if err := db.Write(batch, nil); err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+// coinStrings reads every coin from an iterator (as "txid:vout height amount address")
+func coinStrings(t *testing.T, iter interface{ Next() bool; Coin() *Coin; Err() error }) []string {
+    var coins []string
+    for iter.Next() {
+        c := iter.Coin()
+        coins = append(coins, fmt.Sprintf("%x:%d %d %d %s", c.TxID, c.Vout, c.Height, c.Amount, c.Address))
+    }
+    if err := iter.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return coins
+}
+
+func TestParallelIterator(t *testing.T) {
+    db := parallelTestDB(t)
+    defer db.Close()
+
+    for _, filter := range []bool{false, true} {
+        options := &Options{}
+        if filter {
+            options.Filter = func(coin *Coin) bool { return coin.Amount%3000 == 0 }
+        }
+
+        iter, err := NewIterator(db, options)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := coinStrings(t, iter)
+        iter.Close()
+        if len(want) == 0 {
+            t.Fatal("no coins")
+        }
+        sorted := append([]string{}, want...)
+        sort.Strings(sorted)
+
+        for _, parallel := range []ParallelOptions{{1, 1, true}, {4, 3, true}, {256, 8, true}, {1, 1, false}, {4, 3, false}, {256, 8, false}} {
+            p, err := NewParallelIterator(db, options, parallel)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := coinStrings(t, p)
+            p.Close()
+
+            // Ordered: exactly the same coins in the same order as Iterator. Unordered: the same set of coins.
+            if !parallel.Ordered {
+                sort.Strings(got)
+                if strings.Join(got, "\n") != strings.Join(sorted, "\n") {
+                    t.Errorf("filter %v, %+v: got %d coins, want the same %d coins as Iterator", filter, parallel, len(got), len(want))
+                }
+                continue
+            }
+            if strings.Join(got, "\n") != strings.Join(want, "\n") {
+                t.Errorf("filter %v, %+v: got %d coins, want the same %d coins in the same order as Iterator", filter, parallel, len(got), len(want))
+            }
+        }
+    }
+}
+
+// TestParallelIteratorClose stops part way through (with the readers and workers still busy), which shouldn't hang or leave goroutines running
+func TestParallelIteratorClose(t *testing.T) {
+    db := parallelTestDB(t)
+    defer db.Close()
+    goroutines := runtime.NumGoroutine()
+
+    for _, ordered := range []bool{true, false} {
+        p, err := NewParallelIterator(db, nil, ParallelOptions{Ranges: 4, Workers: 2, Ordered: ordered})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 10 && p.Next(); i++ {
+        }
+
+        closed := make(chan error)
+        go func() {
+            closed <- p.Close()
+        }()
+        select {
+        case err := <-closed:
+            if err != nil {
+                t.Fatal(err)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("ordered %v: Close didn't return", ordered)
+        }
+        if err := p.Close(); err != nil { // closing twice is fine
+            t.Fatal(err)
+        }
+    }
+
+    for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; time.Sleep(10 * time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatalf("%d goroutines still running after Close (%d before)", runtime.NumGoroutine(), goroutines)
+        }
+    }
+}
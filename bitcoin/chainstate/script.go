@@ -0,0 +1,195 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/keys" // checking decompressed public keys
+import "encoding/binary"
+import "strconv"
+
+// maxScriptSize is the biggest script Bitcoin Core will decompress from the chainstate (bigger ones are read back as a single OP_RETURN)
+const maxScriptSize = 10000
+
+// ScriptPubKey rebuilds the complete locking script from the nsize and the script in its storage form (the same as Bitcoin Core's DecompressScript).
+func ScriptPubKey(nsize int64, script []byte) []byte {
+    return AppendScriptPubKey(make([]byte, 0, len(script)+6), nsize, script)
+}
+
+// AppendScriptPubKey appends the complete locking script to b (so the output formats can build it straight in to their buffers).
+func AppendScriptPubKey(b []byte, nsize int64, script []byte) []byte {
+
+    //  0  = P2PKH  OP_DUP OP_HASH160 OP_PUSHBYTES_20 <hash160> OP_EQUALVERIFY OP_CHECKSIG
+    //  1  = P2SH   OP_HASH160 OP_PUSHBYTES_20 <hash160> OP_EQUAL
+    //  2  = P2PK   OP_PUSHBYTES_33 <02publickey> OP_CHECKSIG
+    //  3  = P2PK   OP_PUSHBYTES_33 <03publickey> OP_CHECKSIG
+    //  4  = P2PK   OP_PUSHBYTES_65 <04publickey> OP_CHECKSIG (decompressed when the coin was decoded)
+    //  5  = P2PK   OP_PUSHBYTES_65 <04publickey> OP_CHECKSIG
+    //  6+ = complete script already
+    switch {
+    case nsize == 0:
+        b = append(b, 0x76, 0xa9, 0x14)
+        b = append(b, script...)
+        return append(b, 0x88, 0xac)
+    case nsize == 1:
+        b = append(b, 0xa9, 0x14)
+        b = append(b, script...)
+        return append(b, 0x87)
+    case nsize == 4 || nsize == 5:
+        // Bitcoin Core leaves the script empty if the x coordinate isn't on the curve (it only ever stores valid keys this way, so this would mean the database is corrupt)
+        if !keys.ValidPublicKey(script) {
+            return b
+        }
+        fallthrough
+    case 1 < nsize && nsize < 6:
+        b = append(b, byte(len(script))) // 33 or 65
+        b = append(b, script...)
+        return append(b, 0xac)
+    case len(script) > maxScriptSize:
+        return append(b, 0x6a) // OP_RETURN
+    }
+
+    return append(b, script...)
+}
+
+// scriptOp reads the opcode at pc in a script, and the data it pushes if it's a push (the same as Bitcoin Core's GetOp). It returns the position of the next opcode, or ok = false if a push runs past the end of the script.
+//
+//   0x01-0x4b  push that many bytes
+//   0x4c       OP_PUSHDATA1 [size (1 byte)] [data]
+//   0x4d       OP_PUSHDATA2 [size (2 bytes, little-endian)] [data]
+//   0x4e       OP_PUSHDATA4 [size (4 bytes, little-endian)] [data]
+func scriptOp(script []byte, pc int) (opcode byte, data []byte, next int, ok bool) {
+    opcode = script[pc]
+    pc++
+    if opcode > 0x4e { // not a push
+        return opcode, nil, pc, true
+    }
+
+    size := uint64(opcode)
+    switch opcode {
+    case 0x4c:
+        if len(script)-pc < 1 {
+            return opcode, nil, pc, false
+        }
+        size = uint64(script[pc])
+        pc++
+    case 0x4d:
+        if len(script)-pc < 2 {
+            return opcode, nil, pc, false
+        }
+        size = uint64(binary.LittleEndian.Uint16(script[pc:]))
+        pc += 2
+    case 0x4e:
+        if len(script)-pc < 4 {
+            return opcode, nil, pc, false
+        }
+        size = uint64(binary.LittleEndian.Uint32(script[pc:]))
+        pc += 4
+    }
+    if uint64(len(script)-pc) < size {
+        return opcode, nil, pc, false
+    }
+    return opcode, script[pc : pc+int(size)], pc + int(size), true
+}
+
+// AppendAsm appends the disassembly of a complete script (a scriptpubkey) to b, the same as bitcoin-cli decodescript shows it (Bitcoin Core's ScriptToAsmStr).
+//
+//   76a914751e76e8199196d454941c45d1b3a323f1433bd688ac -> OP_DUP OP_HASH160 751e76e8199196d454941c45d1b3a323f1433bd6 OP_EQUALVERIFY OP_CHECKSIG
+//   5121<pubkey>21<pubkey>52ae                         -> 1 <pubkey> <pubkey> 2 OP_CHECKMULTISIG
+//
+// Pushes of more than 4 bytes are shown in hex, and shorter ones as the number they'd be on the stack (so OP_0 and OP_1 to OP_16 are shown as numbers too, like bitcoin core does). If a push runs past the end of the script, the rest is shown as [error].
+func AppendAsm(b []byte, script []byte) []byte {
+    for pc := 0; pc < len(script); {
+        if pc > 0 {
+            b = append(b, ' ')
+        }
+
+        opcode, data, next, ok := scriptOp(script, pc)
+        if !ok {
+            return append(b, "[error]"...)
+        }
+        pc = next
+
+        switch {
+        case opcode <= 0x4e && len(data) <= 4: // small push
+            b = strconv.AppendInt(b, scriptNum(data), 10)
+        case opcode <= 0x4e:
+            for _, c := range data {
+                b = append(b, hexDigits[c>>4], hexDigits[c&0x0f])
+            }
+        default:
+            b = append(b, opcodeName(opcode)...)
+        }
+    }
+    return b
+}
+
+// hexDigits are the digits used to write bytes as hex
+const hexDigits = "0123456789abcdef"
+
+// scriptNum decodes a number pushed on to the stack (little-endian, with the top bit of the last byte as the sign)
+func scriptNum(data []byte) int64 {
+    if len(data) == 0 {
+        return 0
+    }
+    var n int64
+    for i, c := range data {
+        n |= int64(c) << (8 * uint(i))
+    }
+    if data[len(data)-1]&0x80 != 0 {
+        return -(n &^ (0x80 << (8 * uint(len(data)-1))))
+    }
+    return n
+}
+
+// opcodeName gets the name of an opcode that isn't a push (the same names as bitcoin core)
+func opcodeName(opcode byte) string {
+    switch {
+    case opcode == 0x4f:
+        return "-1" // OP_1NEGATE
+    case 0x51 <= opcode && opcode <= 0x60: // OP_1 to OP_16
+        return smallNumbers[opcode-0x51]
+    case 0xb3 <= opcode && opcode <= 0xb9: // OP_NOP4 to OP_NOP10
+        return nopNames[opcode-0xb3]
+    }
+    if name, ok := opcodeNames[opcode]; ok {
+        return name
+    }
+    return "OP_UNKNOWN"
+}
+
+var smallNumbers = []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16"}
+
+var nopNames = []string{"OP_NOP4", "OP_NOP5", "OP_NOP6", "OP_NOP7", "OP_NOP8", "OP_NOP9", "OP_NOP10"}
+
+// opcodeNames are the names of the rest of the opcodes
+var opcodeNames = map[byte]string{
+    // control
+    0x50: "OP_RESERVED", 0x61: "OP_NOP", 0x62: "OP_VER", 0x63: "OP_IF", 0x64: "OP_NOTIF", 0x65: "OP_VERIF", 0x66: "OP_VERNOTIF",
+    0x67: "OP_ELSE", 0x68: "OP_ENDIF", 0x69: "OP_VERIFY", 0x6a: "OP_RETURN",
+
+    // stack
+    0x6b: "OP_TOALTSTACK", 0x6c: "OP_FROMALTSTACK", 0x6d: "OP_2DROP", 0x6e: "OP_2DUP", 0x6f: "OP_3DUP", 0x70: "OP_2OVER",
+    0x71: "OP_2ROT", 0x72: "OP_2SWAP", 0x73: "OP_IFDUP", 0x74: "OP_DEPTH", 0x75: "OP_DROP", 0x76: "OP_DUP", 0x77: "OP_NIP",
+    0x78: "OP_OVER", 0x79: "OP_PICK", 0x7a: "OP_ROLL", 0x7b: "OP_ROT", 0x7c: "OP_SWAP", 0x7d: "OP_TUCK",
+
+    // splice
+    0x7e: "OP_CAT", 0x7f: "OP_SUBSTR", 0x80: "OP_LEFT", 0x81: "OP_RIGHT", 0x82: "OP_SIZE",
+
+    // bitwise logic
+    0x83: "OP_INVERT", 0x84: "OP_AND", 0x85: "OP_OR", 0x86: "OP_XOR", 0x87: "OP_EQUAL", 0x88: "OP_EQUALVERIFY",
+    0x89: "OP_RESERVED1", 0x8a: "OP_RESERVED2",
+
+    // numeric
+    0x8b: "OP_1ADD", 0x8c: "OP_1SUB", 0x8d: "OP_2MUL", 0x8e: "OP_2DIV", 0x8f: "OP_NEGATE", 0x90: "OP_ABS", 0x91: "OP_NOT",
+    0x92: "OP_0NOTEQUAL", 0x93: "OP_ADD", 0x94: "OP_SUB", 0x95: "OP_MUL", 0x96: "OP_DIV", 0x97: "OP_MOD", 0x98: "OP_LSHIFT",
+    0x99: "OP_RSHIFT", 0x9a: "OP_BOOLAND", 0x9b: "OP_BOOLOR", 0x9c: "OP_NUMEQUAL", 0x9d: "OP_NUMEQUALVERIFY",
+    0x9e: "OP_NUMNOTEQUAL", 0x9f: "OP_LESSTHAN", 0xa0: "OP_GREATERTHAN", 0xa1: "OP_LESSTHANOREQUAL",
+    0xa2: "OP_GREATERTHANOREQUAL", 0xa3: "OP_MIN", 0xa4: "OP_MAX", 0xa5: "OP_WITHIN",
+
+    // crypto
+    0xa6: "OP_RIPEMD160", 0xa7: "OP_SHA1", 0xa8: "OP_SHA256", 0xa9: "OP_HASH160", 0xaa: "OP_HASH256",
+    0xab: "OP_CODESEPARATOR", 0xac: "OP_CHECKSIG", 0xad: "OP_CHECKSIGVERIFY", 0xae: "OP_CHECKMULTISIG",
+    0xaf: "OP_CHECKMULTISIGVERIFY",
+
+    // expansion
+    0xb0: "OP_NOP1", 0xb1: "OP_CHECKLOCKTIMEVERIFY", 0xb2: "OP_CHECKSEQUENCEVERIFY", 0xba: "OP_CHECKSIGADD",
+
+    0xff: "OP_INVALIDOPCODE",
+}
@@ -0,0 +1,99 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/keys" // decompressing stored public keys
+import "bytes"
+import "encoding/hex"
+import "strings"
+import "testing"
+
+// TestAppendScriptPubKey checks each nsize the same as bitcoin core's DecompressScript (the scripts are in their storage form, with nsize 4 and 5 decompressed the way decodeTxOut does it)
+func TestAppendScriptPubKey(t *testing.T) {
+    gx := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" // generator point (even y)
+    gy := "483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"
+    genesisX := "678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb6" // genesis block public key (odd y)
+    genesisY := "49f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f"
+    notOnCurve := strings.Repeat("00", 32)                                            // x = 0 (0^3 + 7 has no square root mod p)
+
+    tests := []struct {
+        nsize  int64
+        script string
+        want   string
+    }{
+        {0, "751e76e8199196d454941c45d1b3a323f1433bd6", "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac"},
+        {1, "751e76e8199196d454941c45d1b3a323f1433bd6", "a914751e76e8199196d454941c45d1b3a323f1433bd687"},
+        {2, "02" + gx, "2102" + gx + "ac"},
+        {3, "03" + genesisX, "2103" + genesisX + "ac"},
+        {4, "04" + gx, "4104" + gx + gy + "ac"},
+        {5, "05" + genesisX, "4104" + genesisX + genesisY + "ac"},
+        {4, "04" + notOnCurve, ""}, // bitcoin core leaves the script empty if the key won't decompress
+        {5, "05" + notOnCurve, ""},
+        {6 + 22, "0014751e76e8199196d454941c45d1b3a323f1433bd6", "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+        {6 + 1, "6a", "6a"},
+        {6 + 10001, strings.Repeat("00", 10001), "6a"}, // too big to decompress (read back as OP_RETURN)
+    }
+    for _, test := range tests {
+        script, _ := hex.DecodeString(test.script)
+        if test.nsize == 4 || test.nsize == 5 {
+            script = keys.DecompressPublicKey(script)
+        }
+        if got := hex.EncodeToString(ScriptPubKey(test.nsize, script)); got != test.want {
+            t.Errorf("nsize %d %.16s: got %s, want %s", test.nsize, test.script, got, test.want)
+        }
+
+        // Appending keeps what's already there
+        prefix := []byte("prefix")
+        got := AppendScriptPubKey(prefix, test.nsize, script)
+        if !bytes.HasPrefix(got, prefix) || hex.EncodeToString(got[len(prefix):]) != test.want {
+            t.Errorf("nsize %d %.16s: appended %x", test.nsize, test.script, got)
+        }
+    }
+}
+
+// TestAppendAsm checks the disassembly against what bitcoin core's ScriptToAsmStr gives (the first few are from core's script_GetScriptAsm test)
+func TestAppendAsm(t *testing.T) {
+    derSig := "304502207fa7a6d1e0ee81132a269ad84e68d695483745cde8b541e3bf630749894e342a022100c1f7ab20e13e22fb95281a870f3dcf38d782e53023ee313d741ad0cfbc0c5090"
+    pubKey := "03b0da749730dc9b4b1f4a14d6902877a92541f5368778853d9c4a0cb7802dcfb2"
+
+    tests := []struct {
+        script string
+        want   string
+    }{
+        {"b1", "OP_CHECKLOCKTIMEVERIFY"}, // OP_NOP2
+        {"b2", "OP_CHECKSEQUENCEVERIFY"}, // OP_NOP3
+        {"48" + derSig + "00" + "21" + pubKey, derSig + "00 " + pubKey},
+        {"76a914751e76e8199196d454941c45d1b3a323f1433bd688ac", "OP_DUP OP_HASH160 751e76e8199196d454941c45d1b3a323f1433bd6 OP_EQUALVERIFY OP_CHECKSIG"},
+        {"0014751e76e8199196d454941c45d1b3a323f1433bd6", "0 751e76e8199196d454941c45d1b3a323f1433bd6"},
+        {"5121" + pubKey + "51ae", "1 " + pubKey + " 1 OP_CHECKMULTISIG"},
+
+        // Pushes of up to 4 bytes are shown as numbers
+        {"6a046f6d6e69", "OP_RETURN 1768844655"},
+        {"0181", "-1"},
+        {"0180", "0"}, // negative zero
+        {"02ff00", "255"},
+        {"04ffffffff", "-2147483647"},
+        {"4c00", "0"}, // OP_PUSHDATA1 of nothing
+        {"4d0300010203", "197121"},
+        {"0500000000ff", "00000000ff"},
+
+        // Opcodes that aren't pushes
+        {"4f", "-1"}, // OP_1NEGATE
+        {"60", "16"},
+        {"50", "OP_RESERVED"},
+        {"b3b9", "OP_NOP4 OP_NOP10"},
+        {"ba", "OP_CHECKSIGADD"},
+        {"bb", "OP_UNKNOWN"},
+        {"ff", "OP_INVALIDOPCODE"},
+
+        // Pushes that run past the end
+        {"6a0501", "OP_RETURN [error]"},
+        {"4c", "[error]"},
+        {"4e01000000", "[error]"},
+        {"", ""},
+    }
+    for _, test := range tests {
+        script, _ := hex.DecodeString(test.script)
+        if got := string(AppendAsm(nil, script)); got != test.want {
+            t.Errorf("%s: got %q, want %q", test.script, got, test.want)
+        }
+    }
+}
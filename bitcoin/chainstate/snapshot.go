@@ -0,0 +1,393 @@
+package chainstate
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128 decoding
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "os"
+
+// snapshotMagic is the start of a snapshot file written by bitcoin core 28 and later
+var snapshotMagic = []byte{'u', 't', 'x', 'o', 0xff}
+
+// snapshotVersion is the version of the snapshot format with a header and coins grouped by txid
+const snapshotVersion = 2
+
+// maxSnapshotScript is the biggest script we'll read from a snapshot (anything bigger means the file is corrupt)
+const maxSnapshotScript = 1 << 20
+
+// networkMagics are the message start bytes of each network (stored in the snapshot header)
+var networkMagics = map[string]string{
+    "f9beb4d9": "main",
+    "0b110907": "test",
+    "1c163f28": "testnet4",
+    "0a03cf40": "signet",
+    "fabfb5da": "regtest",
+}
+
+// SnapshotMetadata is the header of a snapshot file.
+type SnapshotMetadata struct {
+    Version       uint16 // 0 for the original format (bitcoin core 26 and 27), which doesn't have a header
+    NetworkMagic  []byte // message start bytes of the network (nil for version 0)
+    BaseBlockHash []byte // hash of the block the snapshot was taken at (big-endian, the way it's usually displayed)
+    CoinsCount    uint64 // number of coins in the snapshot
+}
+
+// Network returns the name of the network the snapshot is for (main, test, testnet4, signet, regtest), or an empty string if it's not known.
+func (m *SnapshotMetadata) Network() string {
+    return networkMagics[hex.EncodeToString(m.NetworkMagic)]
+}
+
+// SnapshotReader steps through every coin in a utxo snapshot file written by `bitcoin-cli dumptxoutset`.
+//
+// The coins are stored the same way as in the chainstate (but without the obfuscation), so they're decoded in to the same Coins:
+//
+//   [magic "utxo\xff"] [version (uint16)] [network magic (4 bytes)] [base block hash (32 bytes)] [coins count (uint64)]
+//   [txid (32 bytes)] [number of coins (compact size)] [vout (compact size)] [coin] [vout (compact size)] [coin] ...
+//   [txid (32 bytes)] ...
+//
+// Version 0 snapshots (bitcoin core 26 and 27) just have the base block hash and coins count at the start, followed by
+// [txid (32 bytes)] [vout (uint32)] [coin] for every coin.
+type SnapshotReader struct {
+    Metadata SnapshotMetadata
+
+    f         io.Closer // nil if the file wasn't opened by this reader
+    r         *bufio.Reader
+    options   Options
+    coin      Coin
+    value     []byte // coin serialization (in the same form as a chainstate value)
+    read      uint64 // number of coins read so far
+    txid      []byte // txid of the current group of coins (big-endian)
+    remaining uint64 // coins left in the current group
+    err       error
+}
+
+// OpenSnapshot opens a snapshot file and reads its header. Close the reader to close the file.
+func OpenSnapshot(file string, options *Options) (*SnapshotReader, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    s, err := NewSnapshotReader(f, options)
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+    s.f = f // closed with the reader
+    return s, nil
+}
+
+// NewSnapshotReader reads the header of a snapshot and returns a reader over its coins.
+func NewSnapshotReader(r io.Reader, options *Options) (*SnapshotReader, error) {
+
+    s := &SnapshotReader{r: bufio.NewReaderSize(r, 1<<20)}
+    if options != nil {
+        s.options = *options
+    }
+
+    // Header
+    start, err := s.r.Peek(len(snapshotMagic))
+    if err != nil {
+        return nil, fmt.Errorf("%w: snapshot header: %v", ErrMalformed, err)
+    }
+    if bytes.Equal(start, snapshotMagic) {
+        header := make([]byte, len(snapshotMagic)+2+4)
+        if _, err := io.ReadFull(s.r, header); err != nil {
+            return nil, fmt.Errorf("%w: snapshot header: %v", ErrMalformed, err)
+        }
+        s.Metadata.Version = binary.LittleEndian.Uint16(header[5:7])
+        if s.Metadata.Version != snapshotVersion {
+            return nil, fmt.Errorf("unsupported snapshot version %d (expected %d)", s.Metadata.Version, snapshotVersion)
+        }
+        s.Metadata.NetworkMagic = header[7:11]
+    }
+
+    var blockhash [32]byte
+    if _, err := io.ReadFull(s.r, blockhash[:]); err != nil {
+        return nil, fmt.Errorf("%w: snapshot header: %v", ErrMalformed, err)
+    }
+    s.Metadata.BaseBlockHash = reverseBytes(blockhash[:])
+    if err := binary.Read(s.r, binary.LittleEndian, &s.Metadata.CoinsCount); err != nil {
+        return nil, fmt.Errorf("%w: snapshot header: %v", ErrMalformed, err)
+    }
+
+    return s, nil
+}
+
+// Next moves to the next coin. It returns false when there are no more coins or an error occurred.
+func (s *SnapshotReader) Next() bool {
+
+    for s.err == nil && s.read < s.Metadata.CoinsCount {
+
+        s.coin = Coin{}
+        if err := s.readCoin(); err != nil {
+            s.err = fmt.Errorf("%w: coin %d of %d: %v", ErrMalformed, s.read+1, s.Metadata.CoinsCount, err)
+            return false
+        }
+        s.read++
+
+        // Skip coins that don't match the filter
+        if s.options.Filter != nil && !s.options.Filter(&s.coin) {
+            continue
+        }
+
+        // Address (and multisig details)
+        s.options.encode(&s.coin)
+
+        return true
+    }
+
+    // Make sure there's nothing after the last coin (bitcoin core won't load the snapshot if there is)
+    if s.err == nil && s.read == s.Metadata.CoinsCount {
+        if _, err := s.r.Peek(1); err != io.EOF {
+            s.err = fmt.Errorf("%w: snapshot has more data after the last of its %d coins", ErrMalformed, s.Metadata.CoinsCount)
+        }
+        s.read++ // only check once
+    }
+
+    return false
+}
+
+// readCoin reads the outpoint and value of the next coin
+func (s *SnapshotReader) readCoin() error {
+
+    // Outpoint
+    if s.Metadata.Version == 0 {
+        txid := make([]byte, 32)
+        if _, err := io.ReadFull(s.r, txid); err != nil {
+            return err
+        }
+        var vout uint32
+        if err := binary.Read(s.r, binary.LittleEndian, &vout); err != nil {
+            return err
+        }
+        s.coin.TxID = reverseBytes(txid)
+        s.coin.Vout = int64(vout)
+    } else {
+        if s.remaining == 0 { // start of a new txid
+            txid := make([]byte, 32)
+            if _, err := io.ReadFull(s.r, txid); err != nil {
+                return err
+            }
+            count, err := readCompactSize(s.r)
+            if err != nil {
+                return err
+            }
+            if count == 0 {
+                return fmt.Errorf("txid with no coins")
+            }
+            s.txid, s.remaining = reverseBytes(txid), count
+        }
+        vout, err := readCompactSize(s.r)
+        if err != nil {
+            return err
+        }
+        s.coin.TxID = s.txid
+        s.coin.Vout = int64(vout)
+        s.remaining--
+    }
+
+    // Value - same as in the chainstate, so collect the bytes and decode them the same way
+    //
+    //   [height*2+coinbase (varint)] [amount (varint)] [nsize (varint)] [script]
+    s.value = s.value[:0]
+    var nsize int64
+    for i := 0; i < 3; i++ {
+        start := len(s.value)
+        for {
+            b, err := s.r.ReadByte()
+            if err != nil {
+                return err
+            }
+            s.value = append(s.value, b)
+            if b&128 == 0 {
+                break
+            }
+            if len(s.value)-start > 10 {
+                return fmt.Errorf("varint too long")
+            }
+        }
+        nsize = btcleveldb.Varint128Decode(s.value[start:])
+    }
+
+    var size int64
+    switch {
+    case nsize < 2:
+        size = 20 // hash160
+    case nsize < 6:
+        size = 32 // x coordinate of the public key (the nsize is the first byte)
+    default:
+        size = nsize - 6
+    }
+    if size < 0 || size > maxSnapshotScript {
+        return fmt.Errorf("script size %d is not valid", size)
+    }
+    start := len(s.value)
+    s.value = append(s.value, make([]byte, size)...)
+    if _, err := io.ReadFull(s.r, s.value[start:]); err != nil {
+        return err
+    }
+
+    return DecodeValue(&s.coin, s.value, &decodeOptions) // address is encoded after filtering
+}
+
+// Coin returns the current coin. It is only valid until the next call to Next.
+func (s *SnapshotReader) Coin() *Coin {
+    return &s.coin
+}
+
+// Err returns the first error encountered while reading.
+func (s *SnapshotReader) Err() error {
+    return s.err
+}
+
+// Close closes the file (if it was opened with OpenSnapshot).
+func (s *SnapshotReader) Close() error {
+    if s.f != nil {
+        return s.f.Close()
+    }
+    return nil
+}
+
+// readCompactSize reads a compact size number (1, 3, 5 or 9 bytes)
+func readCompactSize(r *bufio.Reader) (uint64, error) {
+    first, err := r.ReadByte()
+    if err != nil {
+        return 0, err
+    }
+    var size int
+    switch first {
+    case 0xfd:
+        size = 2
+    case 0xfe:
+        size = 4
+    case 0xff:
+        size = 8
+    default:
+        return uint64(first), nil
+    }
+    buf := make([]byte, 8)
+    if _, err := io.ReadFull(r, buf[:size]); err != nil {
+        return 0, err
+    }
+    return binary.LittleEndian.Uint64(buf), nil
+}
+
+// reverseBytes reverses a byte slice in place (and returns it)
+func reverseBytes(b []byte) []byte {
+    for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+        b[i], b[j] = b[j], b[i]
+    }
+    return b
+}
+
+// NetworkMagic returns the message start bytes for a network name (main, test, testnet4, signet, regtest).
+func NetworkMagic(network string) ([]byte, error) {
+    for magic, name := range networkMagics {
+        if name == network {
+            return hex.DecodeString(magic)
+        }
+    }
+    return nil, fmt.Errorf("unknown network '%s'", network)
+}
+
+// snapshotCoinsCountOffset is where the coins count is in a snapshot header (so it can be filled in at the end)
+const snapshotCoinsCountOffset = 5 + 2 + 4 + 32
+
+// SnapshotWriter writes coins to a snapshot file in the format that `bitcoin-cli loadtxoutset` reads (version 2).
+//
+// Coins have to be added in chainstate order (so the coins for each txid are together). If the writer is also an
+// io.WriterAt (e.g. an *os.File), the coins count in the header is filled in when the writer is closed, so it doesn't
+// need to be known at the start.
+type SnapshotWriter struct {
+    w        io.Writer
+    metadata SnapshotMetadata
+    count    uint64 // coins written so far
+
+    txid  []byte // txid of the current group of coins (big-endian)
+    coins uint64 // number of coins in the current group
+    group []byte // serialized coins in the current group
+}
+
+// NewSnapshotWriter writes the header of a snapshot. The metadata needs the network magic and base block hash, and the coins count if w isn't an io.WriterAt.
+func NewSnapshotWriter(w io.Writer, metadata *SnapshotMetadata) (*SnapshotWriter, error) {
+    if len(metadata.NetworkMagic) != 4 || len(metadata.BaseBlockHash) != 32 {
+        return nil, fmt.Errorf("snapshot needs a 4 byte network magic and a 32 byte base block hash")
+    }
+
+    s := &SnapshotWriter{w: w, metadata: *metadata}
+    s.metadata.Version = snapshotVersion
+
+    header := append([]byte{}, snapshotMagic...)
+    header = binary.LittleEndian.AppendUint16(header, snapshotVersion)
+    header = append(header, metadata.NetworkMagic...)
+    for i := len(metadata.BaseBlockHash) - 1; i >= 0; i-- { // little-endian
+        header = append(header, metadata.BaseBlockHash[i])
+    }
+    header = binary.LittleEndian.AppendUint64(header, metadata.CoinsCount)
+    if _, err := w.Write(header); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Add writes a coin to the snapshot. The coin needs its value decoded.
+func (s *SnapshotWriter) Add(coin *Coin) error {
+    if s.coins > 0 && !bytes.Equal(coin.TxID, s.txid) {
+        if err := s.flush(); err != nil {
+            return err
+        }
+    }
+    if s.coins == 0 {
+        s.txid = append(s.txid[:0], coin.TxID...)
+    }
+
+    s.group = appendCompactSize(s.group, uint64(coin.Vout))
+    s.group = EncodeValue(s.group, coin)
+    s.coins++
+    s.count++
+    return nil
+}
+
+// flush writes the current group of coins: [txid (32 bytes)] [number of coins (compact size)] [vout (compact size)] [coin] ...
+func (s *SnapshotWriter) flush() error {
+    b := make([]byte, 0, 32+9)
+    for i := len(s.txid) - 1; i >= 0; i-- { // little-endian
+        b = append(b, s.txid[i])
+    }
+    b = appendCompactSize(b, s.coins)
+    if _, err := s.w.Write(b); err != nil {
+        return err
+    }
+    if _, err := s.w.Write(s.group); err != nil {
+        return err
+    }
+    s.coins, s.group = 0, s.group[:0]
+    return nil
+}
+
+// Count returns the number of coins written so far.
+func (s *SnapshotWriter) Count() uint64 {
+    return s.count
+}
+
+// Close writes the last group of coins and fills in the coins count in the header (it does not close w).
+func (s *SnapshotWriter) Close() error {
+    if s.coins > 0 {
+        if err := s.flush(); err != nil {
+            return err
+        }
+    }
+    if s.count == s.metadata.CoinsCount {
+        return nil
+    }
+
+    wa, ok := s.w.(io.WriterAt)
+    if !ok {
+        return fmt.Errorf("snapshot has %d coins but its header says %d", s.count, s.metadata.CoinsCount)
+    }
+    _, err := wa.WriteAt(binary.LittleEndian.AppendUint64(nil, s.count), snapshotCoinsCountOffset)
+    return err
+}
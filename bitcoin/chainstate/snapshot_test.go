@@ -0,0 +1,256 @@
+package chainstate
+
+import "bytes"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+// regtestGenesis is the hash of the regtest genesis block (used as the base block hash of the test snapshots)
+const regtestGenesis = "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206"
+
+// snapshotV2 is a version 2 snapshot of 3 coins, laid out the way `bitcoin-cli dumptxoutset` writes it
+var snapshotV2 = "" +
+    "7574786fff" + "0200" + "fabfb5da" + // magic, version, network magic (regtest)
+    "06226e46111a0b59caaf126043eb5bbf28c34f3a5e332a1fc7b2b73cf188910f" + // base block hash (little-endian)
+    "0300000000000000" + // coins count
+    "982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e" + "02" + // txid, number of coins
+    "00" + "03" + "32" + "1c" + "0014751e76e8199196d454941c45d1b3a323f1433bd6" + // vout 0: height 1 coinbase, 50 btc, p2wpkh (nsize 6+22)
+    "01" + "03" + "00" + "07" + "6a" + // vout 1: height 1 coinbase, 0, OP_RETURN (nsize 6+1)
+    "3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a" + "01" + // txid, number of coins
+    "fd2c01" + "8048" + "04" + "00" + "751e76e8199196d454941c45d1b3a323f1433bd6" // vout 300: height 100, 1000 sats, p2pkh
+
+// snapshotV0 has the last coin of snapshotV2 in an original (version 0) snapshot: no magic or version, and a uint32 vout
+var snapshotV0 = "" +
+    "06226e46111a0b59caaf126043eb5bbf28c34f3a5e332a1fc7b2b73cf188910f" + // base block hash (little-endian)
+    "0100000000000000" + // coins count
+    "3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a" + "2c010000" + // txid, vout
+    "8048" + "04" + "00" + "751e76e8199196d454941c45d1b3a323f1433bd6"
+
+// snapshotCoins are the coins in snapshotV2 (txid:vout height coinbase amount type address)
+var snapshotCoins = []string{
+    "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098:0 1 true 5000000000 p2wpkh bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080",
+    "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098:1 1 true 0 nulldata ",
+    "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b:300 100 false 1000 p2pkh mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r",
+}
+
+// readSnapshot reads every coin in a snapshot (given in hex) in the same form as snapshotCoins
+func readSnapshot(t *testing.T, snapshot string) (*SnapshotReader, []string, error) {
+    b, err := hex.DecodeString(snapshot)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := NewSnapshotReader(bytes.NewReader(b), &Options{Network: "regtest"})
+    if err != nil {
+        return nil, nil, err
+    }
+    var coins []string
+    for s.Next() {
+        c := s.Coin()
+        coins = append(coins, fmt.Sprintf("%x:%d %d %v %d %s %s", c.TxID, c.Vout, c.Height, c.Coinbase, c.Amount, c.Type, c.Address))
+    }
+    return s, coins, s.Err()
+}
+
+func TestSnapshotReader(t *testing.T) {
+    s, coins, err := readSnapshot(t, snapshotV2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    m := s.Metadata
+    if m.Version != 2 || m.Network() != "regtest" || hex.EncodeToString(m.BaseBlockHash) != regtestGenesis || m.CoinsCount != 3 {
+        t.Errorf("metadata: version %d, network %q, base block %x, %d coins", m.Version, m.Network(), m.BaseBlockHash, m.CoinsCount)
+    }
+    if strings.Join(coins, "\n") != strings.Join(snapshotCoins, "\n") {
+        t.Errorf("coins:\n%s\nwant:\n%s", strings.Join(coins, "\n"), strings.Join(snapshotCoins, "\n"))
+    }
+}
+
+func TestSnapshotReaderV0(t *testing.T) {
+    s, coins, err := readSnapshot(t, snapshotV0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    m := s.Metadata
+    if m.Version != 0 || m.NetworkMagic != nil || m.Network() != "" || hex.EncodeToString(m.BaseBlockHash) != regtestGenesis || m.CoinsCount != 1 {
+        t.Errorf("metadata: version %d, network magic %x, base block %x, %d coins", m.Version, m.NetworkMagic, m.BaseBlockHash, m.CoinsCount)
+    }
+    if len(coins) != 1 || coins[0] != snapshotCoins[2] {
+        t.Errorf("coins: %q, want %q", coins, snapshotCoins[2])
+    }
+}
+
+func TestSnapshotReaderMalformed(t *testing.T) {
+    header := snapshotV2[:2*(5+2+4+32)]
+    tests := []struct {
+        name     string
+        snapshot string
+        err      string // part of the error message
+    }{
+        {"empty", "", "snapshot header"},
+        {"short header", snapshotV2[:20], "snapshot header"},
+        {"version 1", "7574786fff0100" + snapshotV2[14:], "unsupported snapshot version 1"},
+        {"more data after the last coin", snapshotV2 + "00", "more data after the last"},
+        {"fewer coins than the count", snapshotV2[:len(snapshotV2)-2], "coin 3 of 3"},
+        {"txid with no coins", header + "0100000000000000" + strings.Repeat("11", 32) + "00", "txid with no coins"},
+        {"script too big", header + "0100000000000000" + strings.Repeat("11", 32) + "01" + "00" + "00" + "00" + "ffffff7f", "not valid"},
+    }
+    for _, test := range tests {
+        _, _, err := readSnapshot(t, test.snapshot)
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+            t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+        }
+        if err != nil && test.name != "version 1" && !errors.Is(err, ErrMalformed) {
+            t.Errorf("%s: %v is not ErrMalformed", test.name, err)
+        }
+    }
+}
+
+// snapshotTestCoins reads the coins back out of snapshotV2 (copied, as the reader reuses its buffers)
+func snapshotTestCoins(t *testing.T) []Coin {
+    b, _ := hex.DecodeString(snapshotV2)
+    s, err := NewSnapshotReader(bytes.NewReader(b), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var coins []Coin
+    for s.Next() {
+        coin := *s.Coin()
+        coin.TxID = append([]byte{}, coin.TxID...)
+        coin.Script = append([]byte{}, coin.Script...)
+        coins = append(coins, coin)
+    }
+    if err := s.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return coins
+}
+
+// writeSnapshot writes coins to a snapshot file with the coins count left at 0 in the metadata (so it gets filled in with WriteAt)
+func writeSnapshot(t *testing.T, coins []Coin) []byte {
+    file := filepath.Join(t.TempDir(), "utxo.dat")
+    f, err := os.Create(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    base, _ := hex.DecodeString(regtestGenesis)
+    magic, _ := NetworkMagic("regtest")
+    s, err := NewSnapshotWriter(f, &SnapshotMetadata{NetworkMagic: magic, BaseBlockHash: base})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := range coins {
+        if err := s.Add(&coins[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if s.Count() != uint64(len(coins)) {
+        t.Errorf("count %d, want %d", s.Count(), len(coins))
+    }
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := f.Close(); err != nil {
+        t.Fatal(err)
+    }
+    b, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+func TestSnapshotWriter(t *testing.T) {
+    coins := snapshotTestCoins(t)
+
+    // File - the coins count gets filled in at the end
+    if got := hex.EncodeToString(writeSnapshot(t, coins)); got != snapshotV2 {
+        t.Errorf("file:\n got %s\nwant %s", got, snapshotV2)
+    }
+
+    // Not an io.WriterAt - the coins count has to be right at the start
+    base, _ := hex.DecodeString(regtestGenesis)
+    magic, _ := NetworkMagic("regtest")
+    for _, count := range []uint64{3, 0} {
+        var buf bytes.Buffer
+        s, err := NewSnapshotWriter(&buf, &SnapshotMetadata{NetworkMagic: magic, BaseBlockHash: base, CoinsCount: count})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := range coins {
+            if err := s.Add(&coins[i]); err != nil {
+                t.Fatal(err)
+            }
+        }
+        err = s.Close()
+        switch {
+        case count == 3 && err != nil:
+            t.Errorf("buffer: %v", err)
+        case count == 3 && hex.EncodeToString(buf.Bytes()) != snapshotV2:
+            t.Errorf("buffer:\n got %x\nwant %s", buf.Bytes(), snapshotV2)
+        case count == 0 && (err == nil || !strings.Contains(err.Error(), "header says 0")):
+            t.Errorf("buffer with the wrong coins count: got %v", err)
+        }
+    }
+
+    // Metadata
+    if _, err := NewSnapshotWriter(&bytes.Buffer{}, &SnapshotMetadata{NetworkMagic: magic, BaseBlockHash: base[:31]}); err == nil {
+        t.Errorf("no error for a 31 byte base block hash")
+    }
+}
+
+// TestSnapshotRoundTrip writes a snapshot with more than 252 coins for one txid and vouts over 252 (both need more than one byte as compact sizes), and reads it back
+func TestSnapshotRoundTrip(t *testing.T) {
+    var coins []Coin
+    for i := 0; i < 5; i++ {
+        txid := bytes.Repeat([]byte{byte(i + 1)}, 32)
+        outputs := []int64{0}
+        switch i {
+        case 1:
+            outputs = []int64{0, 252, 253, 65535, 65536, 70000}
+        case 3:
+            outputs = nil
+            for vout := int64(0); vout < 300; vout++ {
+                outputs = append(outputs, vout)
+            }
+        }
+        for _, vout := range outputs {
+            coin := Coin{TxID: txid, Vout: vout, Height: int64(i) * 100000, Coinbase: vout == 0, Amount: vout * 1000, NSize: 0, Script: testHash160}
+            if vout%3 == 1 {
+                coin.NSize, coin.Script = 6+34, append([]byte{0x00, 0x20}, bytes.Repeat([]byte{byte(vout)}, 32)...) // p2wsh
+            }
+            coins = append(coins, coin)
+        }
+    }
+
+    b := writeSnapshot(t, coins)
+    s, err := NewSnapshotReader(bytes.NewReader(b), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s.Metadata.CoinsCount != uint64(len(coins)) {
+        t.Errorf("coins count %d, want %d", s.Metadata.CoinsCount, len(coins))
+    }
+    i := 0
+    for ; s.Next(); i++ {
+        got, want := s.Coin(), &coins[i]
+        if !bytes.Equal(got.TxID, want.TxID) || got.Vout != want.Vout || got.Height != want.Height || got.Coinbase != want.Coinbase || got.Amount != want.Amount || got.NSize != want.NSize || !bytes.Equal(got.Script, want.Script) {
+            t.Fatalf("coin %d: got %x:%d, want %x:%d", i, got.TxID, got.Vout, want.TxID, want.Vout)
+        }
+    }
+    if err := s.Err(); err != nil {
+        t.Fatal(err)
+    }
+    if i != len(coins) {
+        t.Errorf("read %d coins, want %d", i, len(coins))
+    }
+
+    // The txid with 300 coins has a 3 byte compact size (fd 2c 01) after it
+    txid := bytes.Repeat([]byte{4}, 32)
+    if j := bytes.Index(b, txid); j < 0 || !bytes.Equal(b[j+32:j+35], []byte{0xfd, 0x2c, 0x01}) {
+        t.Errorf("no 3 byte compact size after the txid with 300 coins")
+    }
+}
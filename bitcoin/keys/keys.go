@@ -1,7 +1,7 @@
 package keys
 
 import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/crypto"
-import "github.com/akamensky/base58"
+import "crypto/sha256"
 import "math/big"
 
 func Hash160ToAddress(hash160 []byte, prefix []byte) string {
@@ -12,10 +12,62 @@ func Hash160ToAddress(hash160 []byte, prefix []byte) string {
     //    \                                                                                                / base58 encode
     //     ------------------------------------------address-----------------------------------------------
 
-    hash160_with_prefix := append(prefix, hash160...) // prepend prefix to hash160pubkey (... unpacks the slice)
-    hash160_prepared := append(hash160_with_prefix, crypto.Checksum(hash160_with_prefix)...) // add checksum to the end
-    address := base58.Encode(hash160_prepared)
-    return address
+    // The bytes and the address get built in arrays on the stack, so the only thing allocated is the string at the end (this runs for most of the utxos)
+    var buffer [64]byte
+    hash160_prepared := append(buffer[:0], prefix...) // prepend prefix to hash160pubkey (... unpacks the slice)
+    hash160_prepared = append(hash160_prepared, hash160...)
+    hash1 := sha256.Sum256(hash160_prepared) // checksum = first 4 bytes of hash256
+    hash2 := sha256.Sum256(hash1[:])
+    hash160_prepared = append(hash160_prepared, hash2[:4]...) // add checksum to the end
+
+    var address [64]byte
+    return string(appendBase58(address[:0], hash160_prepared))
+}
+
+// base58Alphabet leaves out 0, O, I and l so they can't be mixed up
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// appendBase58 appends the base58 encoding of some bytes to b
+//
+// It works like long division on the bytes (the same way as bitcoin core), so it doesn't need a big.Int:
+//
+//   [00] [cb c2 98 ...] <- each leading zero byte becomes a 1
+//         //          base 256 -> base 58 digits, one byte at a time
+func appendBase58(b []byte, data []byte) []byte {
+
+    // Leading zeros
+    zeros := 0
+    for zeros < len(data) && data[zeros] == 0 {
+        zeros++
+        b = append(b, '1')
+    }
+
+    // Base 58 digits (log(256)/log(58) = 1.37 digits for each byte, rounded up)
+    size := (len(data)-zeros)*138/100 + 1
+    var buffer [128]byte
+    var digits []byte
+    if size <= len(buffer) {
+        digits = buffer[:size]
+    } else {
+        digits = make([]byte, size)
+    }
+    length := 0 // number of digits used so far (from the end)
+    for _, v := range data[zeros:] {
+        carry := int(v)
+        i := 0
+        for j := size - 1; (carry != 0 || i < length) && j >= 0; j-- {
+            carry += 256 * int(digits[j])
+            digits[j] = byte(carry % 58)
+            carry /= 58
+            i++
+        }
+        length = i
+    }
+
+    for _, v := range digits[size-length:] {
+        b = append(b, base58Alphabet[v])
+    }
+    return b
 }
 
 func PublicKeyToAddress(publickey []byte, prefix []byte) string {
@@ -24,6 +76,10 @@ func PublicKeyToAddress(publickey []byte, prefix []byte) string {
     return address
 }
 
+// secp256k1P is the prime the curve is over, and secp256k1Sqrt is (p+1)/4 (worked out once rather than for every public key)
+var secp256k1P, _ = new(big.Int).SetString("0xfffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 0)
+var secp256k1Sqrt = new(big.Int).Div(new(big.Int).Add(secp256k1P, big.NewInt(1)), big.NewInt(4))
+
 func DecompressPublicKey(publickey []byte) []byte { // decompressing public keys from P2PK scripts
     // first byte (indicates whether y is even or odd)
     prefix := publickey[0:1]
@@ -32,14 +88,14 @@ func DecompressPublicKey(publickey []byte) []byte { // decompressing public keys
     x := publickey[1:]
 
     // y^2 = x^3 + 7 mod p
-    p, _  := new(big.Int).SetString("0xfffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 0)
+    p := secp256k1P
     x_int := new(big.Int).SetBytes(x)
     x_3   := new(big.Int).Exp(x_int, big.NewInt(3), p)
     y_sq  := new(big.Int).Add(x_3, big.NewInt(7))
     y_sq   = new(big.Int).Mod(y_sq, p)
 
     // square root of y - secp256k1 is chosen so that the square root of y is y^((p+1)/4)
-    y := new(big.Int).Exp(y_sq, new(big.Int).Div(new(big.Int).Add(p, big.NewInt(1)), big.NewInt(4)), p)
+    y := new(big.Int).Exp(y_sq, secp256k1Sqrt, p)
 
     // determine if the y we have caluclated is even or odd
     y_mod_2 := new(big.Int).Mod(y, big.NewInt(2))
@@ -69,4 +125,45 @@ func DecompressPublicKey(publickey []byte) []byte { // decompressing public keys
     uncompressed = append(uncompressed, y_bytes...)
     
     return uncompressed
-}
\ No newline at end of file
+}
+
+// ValidPublicKey reports whether a public key is a point on the secp256k1 curve (the same check as Bitcoin Core's CPubKey::IsFullyValid)
+//
+//   02/03 <x>      compressed: x has to be less than p, and x^3 + 7 has to have a square root mod p
+//   04 <x> <y>     uncompressed: x and y have to be less than p, and y^2 = x^3 + 7 mod p
+//   06/07 <x> <y>  hybrid: the same as uncompressed, and y has to be even/odd to match the prefix
+func ValidPublicKey(publickey []byte) bool {
+
+    var x, y *big.Int
+    switch {
+    case len(publickey) == 33 && (publickey[0] == 0x02 || publickey[0] == 0x03):
+        x = new(big.Int).SetBytes(publickey[1:33])
+    case len(publickey) == 65 && (publickey[0] == 0x04 || publickey[0] == 0x06 || publickey[0] == 0x07):
+        x = new(big.Int).SetBytes(publickey[1:33])
+        y = new(big.Int).SetBytes(publickey[33:65])
+    default:
+        return false
+    }
+    if x.Cmp(secp256k1P) >= 0 {
+        return false
+    }
+
+    // x^3 + 7 mod p
+    y_sq := new(big.Int).Exp(x, big.NewInt(3), secp256k1P)
+    y_sq.Add(y_sq, big.NewInt(7))
+    y_sq.Mod(y_sq, secp256k1P)
+
+    // compressed - there's a y for this x if x^3 + 7 is a square mod p
+    if y == nil {
+        return big.Jacobi(y_sq, secp256k1P) != -1
+    }
+
+    // uncompressed - check y
+    if y.Cmp(secp256k1P) >= 0 {
+        return false
+    }
+    if publickey[0] != 0x04 && y.Bit(0) != uint(publickey[0]&1) { // 06 = even y, 07 = odd y
+        return false
+    }
+    return new(big.Int).Exp(y, big.NewInt(2), secp256k1P).Cmp(y_sq) == 0
+}
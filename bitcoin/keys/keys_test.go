@@ -0,0 +1,68 @@
+package keys
+
+import "github.com/akamensky/base58"
+import "bytes"
+import "encoding/hex"
+import "testing"
+
+func TestBase58(t *testing.T) {
+    // Bitcoin Core's base58_encode_decode.json (leading zero bytes are each a 1)
+    tests := []struct {
+        data    string
+        encoded string
+    }{
+        {"", ""},
+        {"61", "2g"},
+        {"626262", "a3gV"},
+        {"636363", "aPEr"},
+        {"73696d706c792061206c6f6e6720737472696e67", "2cFupjhnEsSn59qHXstmK2ffpLv2"},
+        {"00eb15231dfceb60925886b67d065299925915aeb172c06647", "1NS17iag9jJgTHD1VXjvLCEnZuQ3rJDE9L"},
+        {"516b6fcd0f", "ABnLTmg"},
+        {"bf4f89001e670274dd", "3SEo3LWLoPntC"},
+        {"572e4794", "3EFU7m"},
+        {"ecac89cad93923c02321", "EJDM8drfXA6uyA"},
+        {"10c8511e", "Rt5zm"},
+        {"00000000000000000000", "1111111111"},
+        {"000111d38e5fc9071ffcd20b4a763cc9ae4f252bb4e48fd66a835e252ada93ff480d6dd43dc62a641155a5", "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"},
+        {"000000287fb4cd", "111233QC4"},
+    }
+    for _, test := range tests {
+        data, _ := hex.DecodeString(test.data)
+        if got := string(appendBase58(nil, data)); got != test.encoded {
+            t.Errorf("%s: got %s, want %s", test.data, got, test.encoded)
+        }
+    }
+
+    // Appends to what's already there
+    if got := string(appendBase58([]byte("address "), []byte{0, 0x61})); got != "address 12g" {
+        t.Errorf("appended %q", got)
+    }
+
+    // Longer than the digits buffer on the stack, and every number of leading zeros up to 30
+    for zeros := 0; zeros <= 30; zeros++ {
+        data := append(make([]byte, zeros), bytes.Repeat([]byte{0xff, 0x01, 0x80}, 50)...)
+        if got, want := string(appendBase58(nil, data)), base58.Encode(data); got != want {
+            t.Errorf("%d leading zeros: got %s, want %s", zeros, got, want)
+        }
+    }
+}
+
+func TestHash160ToAddress(t *testing.T) {
+    tests := []struct {
+        hash160 string
+        prefix  byte
+        address string
+    }{
+        {"751e76e8199196d454941c45d1b3a323f1433bd6", 0x00, "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+        {"751e76e8199196d454941c45d1b3a323f1433bd6", 0x05, "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw"},
+        {"751e76e8199196d454941c45d1b3a323f1433bd6", 0x6f, "mrCDrCybB6J1vRfbwM5hemdJz73FwDBC8r"},
+        {"0000000000000000000000000000000000000000", 0x00, "1111111111111111111114oLvT2"}, // 21 zero bytes before the checksum
+        {"00000000000000000000000000000000000000ff", 0x00, "11111111111111111111Vp5gvNh"},
+    }
+    for _, test := range tests {
+        hash160, _ := hex.DecodeString(test.hash160)
+        if got := Hash160ToAddress(hash160, []byte{test.prefix}); got != test.address {
+            t.Errorf("%s %02x: got %s, want %s", test.hash160, test.prefix, got, test.address)
+        }
+    }
+}
@@ -0,0 +1,107 @@
+// Package muhash implements MuHash3072, the rolling set hash Bitcoin Core uses for `gettxoutsetinfo muhash`.
+//
+// Each element of the set is hashed to a 3072-bit number, and the hash of the set is the product of those numbers
+// modulo 2^3072 - 1103717. Multiplication doesn't care about order, so elements can be added in any order, and
+// removed again by dividing. A removal is kept in a separate denominator, so only one modular inverse is needed
+// when the hash is finalized.
+//
+//    m := muhash.New()
+//    m.Insert(a)
+//    m.Insert(b)
+//    m.Remove(a)
+//    m.String() // same as a MuHash with only b in it
+package muhash
+
+import "golang.org/x/crypto/chacha20" // expanding element hashes to 3072 bits
+import "crypto/sha256"
+import "encoding/hex"
+import "math/big"
+
+// size is the number of bytes in a 3072-bit number
+const size = 384
+
+// prime is the modulus 2^3072 - 1103717
+var prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+// MuHash3072 is a hash of a set of byte strings. The zero value is not usable; create one with New.
+type MuHash3072 struct {
+    numerator   *big.Int // product of the inserted elements
+    denominator *big.Int // product of the removed elements
+}
+
+// New returns the MuHash of an empty set.
+func New() *MuHash3072 {
+    return &MuHash3072{numerator: big.NewInt(1), denominator: big.NewInt(1)}
+}
+
+// toNum3072 hashes an element to a 3072-bit number: sha256 the data, use that as a chacha20 key, and read 384 bytes of keystream as a little-endian number
+func toNum3072(data []byte) *big.Int {
+    key := sha256.Sum256(data)
+    stream, _ := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize)) // key and nonce are always the right size
+    buf := make([]byte, size)
+    stream.XORKeyStream(buf, buf)
+    return new(big.Int).SetBytes(reverse(buf))
+}
+
+// Insert adds an element to the set.
+func (m *MuHash3072) Insert(data []byte) {
+    m.numerator.Mul(m.numerator, toNum3072(data))
+    m.numerator.Mod(m.numerator, prime)
+}
+
+// Remove takes an element out of the set (it should have been inserted, here or in a MuHash that gets combined with this one).
+func (m *MuHash3072) Remove(data []byte) {
+    m.denominator.Mul(m.denominator, toNum3072(data))
+    m.denominator.Mod(m.denominator, prime)
+}
+
+// Combine adds all the elements of another set to this one (and removes the ones it removed).
+func (m *MuHash3072) Combine(other *MuHash3072) {
+    m.numerator.Mul(m.numerator, other.numerator)
+    m.numerator.Mod(m.numerator, prime)
+    m.denominator.Mul(m.denominator, other.denominator)
+    m.denominator.Mod(m.denominator, prime)
+}
+
+// Subtract removes all the elements of another set from this one (and puts back the ones it removed).
+func (m *MuHash3072) Subtract(other *MuHash3072) {
+    m.numerator.Mul(m.numerator, other.denominator)
+    m.numerator.Mod(m.numerator, prime)
+    m.denominator.Mul(m.denominator, other.numerator)
+    m.denominator.Mod(m.denominator, prime)
+}
+
+// Sum returns the 32-byte hash of the set in the byte order it's displayed in (reversed, like txids).
+func (m *MuHash3072) Sum() []byte {
+
+    // numerator / denominator (mod p), as 384 little-endian bytes
+    result := new(big.Int).ModInverse(m.denominator, prime)
+    result.Mul(result, m.numerator)
+    result.Mod(result, prime)
+    num := make([]byte, size)
+    result.FillBytes(num)
+
+    hash := sha256.Sum256(reverse(num))
+    return reverse(hash[:])
+}
+
+// String returns the hash as hex (as shown by bitcoin-cli).
+func (m *MuHash3072) String() string {
+    return hex.EncodeToString(m.Sum())
+}
+
+// Equal reports whether two MuHashes are of the same set.
+func (m *MuHash3072) Equal(other *MuHash3072) bool {
+    // a/b == c/d  <=>  a*d == c*b
+    left := new(big.Int).Mul(m.numerator, other.denominator)
+    right := new(big.Int).Mul(other.numerator, m.denominator)
+    return left.Mod(left, prime).Cmp(right.Mod(right, prime)) == 0
+}
+
+// reverse reverses a byte slice in place (and returns it)
+func reverse(b []byte) []byte {
+    for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+        b[i], b[j] = b[j], b[i]
+    }
+    return b
+}
@@ -0,0 +1,70 @@
+package muhash
+
+import "testing"
+
+// fromInt is a 32 byte element with i as its first byte (the same as FromInt in bitcoin core's muhash_tests)
+func fromInt(i byte) []byte {
+    data := make([]byte, 32)
+    data[0] = i
+    return data
+}
+
+// TestCoreVector is the vector from bitcoin core's muhash_tests: {0} * {1} / {2}
+func TestCoreVector(t *testing.T) {
+    want := "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863"
+
+    m := New()
+    m.Insert(fromInt(0))
+    m.Insert(fromInt(1))
+    m.Remove(fromInt(2))
+    if got := m.String(); got != want {
+        t.Errorf("got %s, want %s", got, want)
+    }
+
+    // The same set built from separate MuHashes
+    a, b, c := New(), New(), New()
+    a.Insert(fromInt(0))
+    b.Insert(fromInt(1))
+    c.Insert(fromInt(2))
+    a.Combine(b)
+    a.Subtract(c)
+    if got := a.String(); got != want {
+        t.Errorf("combined: got %s, want %s", got, want)
+    }
+}
+
+func TestSetProperties(t *testing.T) {
+    tests := []struct {
+        name string
+        a, b func(m *MuHash3072)
+    }{
+        {"order doesn't matter",
+            func(m *MuHash3072) { m.Insert(fromInt(1)); m.Insert(fromInt(2)); m.Insert(fromInt(3)) },
+            func(m *MuHash3072) { m.Insert(fromInt(3)); m.Insert(fromInt(1)); m.Insert(fromInt(2)) }},
+        {"remove undoes insert",
+            func(m *MuHash3072) { m.Insert(fromInt(1)); m.Insert(fromInt(2)); m.Remove(fromInt(2)) },
+            func(m *MuHash3072) { m.Insert(fromInt(1)) }},
+        {"remove before insert",
+            func(m *MuHash3072) { m.Remove(fromInt(7)); m.Insert(fromInt(7)) },
+            func(m *MuHash3072) {}},
+        {"subtract undoes combine",
+            func(m *MuHash3072) { other := New(); other.Insert(fromInt(5)); m.Insert(fromInt(4)); m.Combine(other); m.Subtract(other) },
+            func(m *MuHash3072) { m.Insert(fromInt(4)) }},
+    }
+    for _, test := range tests {
+        a, b := New(), New()
+        test.a(a)
+        test.b(b)
+        if !a.Equal(b) || a.String() != b.String() {
+            t.Errorf("%s: %s != %s", test.name, a, b)
+        }
+    }
+
+    // Different sets
+    a, b := New(), New()
+    a.Insert(fromInt(1))
+    b.Insert(fromInt(2))
+    if a.Equal(b) || a.String() == b.String() {
+        t.Error("different sets have the same hash")
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import "github.com/klauspost/compress/zstd" // zstd compression (compresses blocks concurrently)
+import "github.com/klauspost/pgzip"         // parallel gzip compression
+import "fmt"
+import "io"
+import "runtime" // number of cpus to compress with
+import "strings"
+
+// Compression that can be selected with the -compress flag (or by the extension of the output file)
+var compressionsAllowed = []string{"none", "gzip", "zstd"}
+
+// compressionFromFilename picks the compression from the output file's extension (e.g. utxodump.csv.gz)
+func compressionFromFilename(file string) string {
+    switch {
+    case strings.HasSuffix(file, ".gz"):
+        return "gzip"
+    case strings.HasSuffix(file, ".zst"):
+        return "zstd"
+    }
+    return "none"
+}
+
+// compressionExtension is the file extension for a compression
+func compressionExtension(compression string) string {
+    switch compression {
+    case "gzip":
+        return ".gz"
+    case "zstd":
+        return ".zst"
+    }
+    return ""
+}
+
+// checkCompression makes sure the compression is one we know about
+func checkCompression(compression string) error {
+    for _, v := range compressionsAllowed {
+        if v == compression {
+            return nil
+        }
+    }
+    return fmt.Errorf("'%s' is not a compression you can use for the output. Choose from the following: %s", compression, strings.Join(compressionsAllowed, ","))
+}
+
+// newCompressor wraps w so that everything written to it gets compressed using all of the cpus. Closing it does not close w.
+func newCompressor(compression string, w io.Writer) (io.WriteCloser, error) {
+    switch compression {
+    case "gzip":
+        gz := pgzip.NewWriter(w)
+        if err := gz.SetConcurrency(1 << 20, runtime.GOMAXPROCS(0)); err != nil { // 1MB blocks, one for each cpu
+            return nil, err
+        }
+        return gz, nil
+    case "zstd":
+        return zstd.NewWriter(w, zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)))
+    }
+    return nil, checkCompression(compression)
+}
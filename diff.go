@@ -0,0 +1,416 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/btcleveldb" // varint128 (the order of the vouts in the keys)
+import "bytes"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "os/signal"
+import "runtime"
+import "strings"
+import "syscall"
+
+// Diff
+//
+// Compares two chainstates (or snapshot files) and writes the utxos that were created and spent between them:
+//
+//   bitcoin-utxo-dump diff ~/chainstate-2023-01-01/ ~/chainstate-2024-01-01/
+//
+//   change,txid,vout,amount,type,address
+//   spent,033e83e3204b0cc28724e147f6fd140529b2537249f9c61c9de9972750030000,0,65279,p2pkh,1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX
+//   created,0340e3b8a4bab58e1e4e7e5e3d2ec51a4af81bc6c24bd5f3b1b5e1c6f4630000,1,1000000,p2wpkh,bc1q...
+//
+// The coins in both databases come out in the same order (sorted by their keys, which is the txid then the vout), so they can be stepped through side by side like a merge join. Only the current coin from each side is held in memory, so it doesn't matter how big they are.
+//
+// A coin is identified by its txid:vout, so a coin that's in both is unchanged (a transaction can't change once it's mined).
+
+// diffSide is one of the inputs being compared
+type diffSide struct {
+    name  string
+    iter  coinIterator
+    where whereExpr        // skip coins that don't match (nil for all coins)
+    coin  *chainstate.Coin // current coin (nil once there are no more)
+
+    // Key of the previous coin (to make sure the coins really are in order)
+    lastTxID []byte
+    lastVout int64
+}
+
+// next moves to the next coin that matches the -where expression
+func (s *diffSide) next() error {
+    for s.iter.Next() {
+        coin := s.iter.Coin()
+        if s.where != nil && !s.where(coin) {
+            continue
+        }
+        if s.lastTxID != nil && compareOutpoints(coin.TxID, coin.Vout, s.lastTxID, s.lastVout) <= 0 {
+            return fmt.Errorf("the coins in %s aren't in order (%x:%d comes after %x:%d)", s.name, coin.TxID, coin.Vout, s.lastTxID, s.lastVout)
+        }
+        s.lastTxID = append(s.lastTxID[:0], coin.TxID...)
+        s.lastVout = coin.Vout
+        s.coin = coin
+        return nil
+    }
+    s.coin = nil
+    return s.iter.Err()
+}
+
+// compareOutpoints compares two coins in the order they're stored in the chainstate. The txid is stored little-endian, so it's compared from the last byte to the first.
+func compareOutpoints(txidA []byte, voutA int64, txidB []byte, voutB int64) int {
+    for i := len(txidA) - 1; i >= 0; i-- {
+        if txidA[i] != txidB[i] {
+            if txidA[i] < txidB[i] {
+                return -1
+            }
+            return 1
+        }
+    }
+    return compareVouts(voutA, voutB)
+}
+
+// compareVouts compares two vouts in the order of their keys. The vout is stored as a varint128, and the bytes of those aren't always in the same order as the numbers:
+//
+//   255    80 7f
+//   16512  80 80 00
+//   256    81 00
+//
+// Up to 16511 (two bytes) the orders are the same, so the numbers are only encoded for the (very rare) bigger vouts.
+func compareVouts(a int64, b int64) int {
+    if a >= 16512 || b >= 16512 {
+        return bytes.Compare(btcleveldb.Varint128Encode(a), btcleveldb.Varint128Encode(b))
+    }
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+    return 0
+}
+
+// diffWriter writes each change as a csv line or json line, with the change (created or spent) before the selected fields
+type diffWriter struct {
+    w      io.Writer
+    format string // csv or jsonl
+    fields []string
+    record fieldAppender // appends the selected fields (the same as the csv or jsonl dump)
+    line   []byte
+}
+
+func newDiffWriter(w io.Writer, format string, fields []string) *diffWriter {
+    d := &diffWriter{w: w, format: format, fields: fields}
+    if format == "csv" {
+        d.record = newCSVWriter(w, fields)
+    } else {
+        d.record = newJSONLWriter(w, fields)
+    }
+    return d
+}
+
+func (d *diffWriter) WriteHeader() error {
+    if d.format != "csv" {
+        return nil // json lines describe themselves
+    }
+    _, err := fmt.Fprintln(d.w, "change,"+strings.Join(d.fields, ","))
+    return err
+}
+
+func (d *diffWriter) WriteChange(change string, count int, coin *chainstate.Coin) error {
+    line := d.line[:0]
+    if d.format == "csv" {
+        line = append(line, change...)
+        line = append(line, ',')
+        line = d.record.appendFields(line, count, coin)
+    } else {
+        line = append(line, `{"change":`...)
+        line = appendJSONString(line, change)
+        line = append(line, ',')
+        line = d.record.appendFields(line, count, coin)
+        line = append(line, '}')
+    }
+    line = append(line, '\n')
+    d.line = line
+    _, err := d.w.Write(line)
+    return err
+}
+
+// diffMain runs the diff command (bitcoin-utxo-dump diff [options] OLD NEW)
+func diffMain(args []string) {
+
+    flags := flag.NewFlagSet("diff", flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintln(flags.Output(), "Usage: bitcoin-utxo-dump diff [options] OLD NEW")
+        fmt.Fprintln(flags.Output())
+        fmt.Fprintln(flags.Output(), "Writes the utxos created and spent between two chainstate folders (or snapshot files made with bitcoin-cli dumptxoutset or -format txoutset).")
+        fmt.Fprintln(flags.Output())
+        flags.PrintDefaults()
+    }
+    defaultfile := "utxodiff.csv"
+    file := flags.String("o", defaultfile, "Name of file to write the changes to. Use - to write to stdout.")
+    fields := flags.String("f", "txid,vout,amount,type,address", "Fields to include after the change (created or spent). [count,txid,vout,height,amount,coinbase,nsize,script,scriptpubkey,asm,type,address,ms_m,ms_n,ms_pubkeys,ms_compressed,ms_valid,ms_addresses,payload,protocol]")
+    format := flags.String("format", "csv", "Format of the output. [csv,jsonl]")
+    compress := flags.String("compress", "", "Compress the output. [none,gzip,zstd] (default is from the extension of the output file: .gz or .zst)")
+    addresses := flags.String("addresses", "", "File with a list of addresses (one per line). Only utxos locked to these addresses are compared.")
+    where := flags.String("where", "", "Only compare utxos that match an expression. e.g. 'amount >= 100000000'")
+    testnetflag := flags.Bool("testnet", false, "Are the chainstates for testnet?")
+    network := flags.String("network", "", "Network the chainstates are for (for the address prefixes). [main,test,testnet4,signet,regtest] (default is from the path or header of OLD, or -testnet)")
+    p2pkaddresses := flags.Bool("p2pkaddresses", false, "Convert public keys in P2PK locking scripts to addresses also.")
+    workers := flags.Int("workers", runtime.NumCPU(), "Number of goroutines decoding utxos from each chainstate.")
+    verbose := flags.Bool("v", false, "Print changes as we find them.")
+    quiet := flags.Bool("quiet", false, "Do not display any progress or results.")
+    flags.Parse(args)
+
+    if flags.NArg() != 2 {
+        flags.Usage()
+        os.Exit(2)
+    }
+    oldpath, newpath := flags.Arg(0), flags.Arg(1)
+
+    // Print messages to stderr if the results are being written to stdout
+    console := os.Stdout
+    if *file == "-" {
+        console = os.Stderr
+    }
+
+    // Fields
+    fieldsSelected := map[string]bool{}
+    for _, v := range strings.Split(*fields, ",") {
+        exists := false
+        for _, w := range fieldsAllowed {
+            if v == w {
+                exists = true
+            }
+        }
+        if !exists {
+            fmt.Fprintf(console, "'%s' is not a field you can use for the output.\n", v)
+            fmt.Fprintf(console, "Choose from the following: %s\n", strings.Join(fieldsAllowed, ","))
+            return
+        }
+        fieldsSelected[v] = true
+    }
+    fieldsDecoded := map[string]bool{}
+    for field := range fieldsSelected {
+        fieldsDecoded[field] = true
+    }
+
+    // Output format and compression
+    if *format != "csv" && *format != "jsonl" {
+        fmt.Fprintf(console, "'%s' is not a format you can use for a diff. Choose from the following: csv,jsonl\n", *format)
+        return
+    }
+    compression := *compress
+    if compression == "" {
+        compression = compressionFromFilename(*file)
+    }
+    if err := checkCompression(compression); err != nil {
+        fmt.Fprintln(console, err)
+        return
+    }
+    if *file == defaultfile {
+        *file = "utxodiff." + *format + compressionExtension(compression)
+    }
+
+    // Filter expression
+    var whereMatch whereExpr
+    if *where != "" {
+        expr, used, err := parseWhere(*where)
+        if err != nil {
+            fmt.Fprintln(console, err)
+            return
+        }
+        whereMatch = expr
+        for _, field := range used {
+            fieldsDecoded[field] = true
+        }
+    }
+
+    // Network (for encoding addresses correctly)
+    switch {
+    case *network != "":
+        if _, err := chainstate.NetworkMagic(*network); err != nil {
+            fmt.Fprintf(console, "%v. Choose from the following: main,test,testnet4,signet,regtest\n", err)
+            return
+        }
+    case *testnetflag:
+        *network = "test"
+    default:
+        inputnetwork, err := inputNetwork(oldpath)
+        if err != nil {
+            fmt.Fprintln(console, err)
+            return
+        }
+        *network = inputnetwork
+    }
+
+    // Decoding options - only decode what we need (comparing coins only needs the txid and vout)
+    options := &chainstate.Options{
+        Network:           *network,
+        P2PKAddresses:     *p2pkaddresses,
+        KeyOnly:           !valueNeeded(fieldsDecoded),
+        NoAddress:         !fieldsDecoded["address"],
+        Multisig:          multisigNeeded(fieldsDecoded),
+        MultisigAddresses: fieldsDecoded["ms_addresses"],
+    }
+    if *addresses != "" {
+        addressSet, err := readAddresses(*addresses)
+        if err != nil {
+            fmt.Fprintln(console, err)
+            return
+        }
+        addressSet.P2PK = *p2pkaddresses
+        options.Filter = addressSet.Match
+        if ! *quiet {
+            fmt.Fprintf(console, "Looking for utxos locked to %d addresses in %s\n", addressSet.Len(), *addresses)
+        }
+    }
+
+    // Open both inputs
+    sides := make([]*diffSide, 2)
+    for i, path := range []string{oldpath, newpath} {
+        iter, block, err := openInput(path, options, *workers)
+        if err != nil {
+            fmt.Fprintf(console, "Couldn't open %s.\n", path)
+            fmt.Fprintln(console, err)
+            return
+        }
+        defer iter.Close()
+        sides[i] = &diffSide{name: path, iter: iter, where: whereMatch}
+        if ! *quiet && block != nil {
+            fmt.Fprintf(console, "%s is at block %x\n", path, block)
+        }
+    }
+    before, after := sides[0], sides[1]
+
+    // Output
+    output, err := createOutputFile(*file, compression)
+    if err != nil {
+        fmt.Fprintln(console, err)
+        return
+    }
+    out := newDiffWriter(output, *format, strings.Split(*fields, ","))
+    display := newDiffWriter(console, *format, out.fields)
+    if ! *quiet {
+        if *file == "-" {
+            fmt.Fprintf(console, "Comparing %s to %s and writing the changes to stdout\n", oldpath, newpath)
+        } else {
+            fmt.Fprintf(console, "Comparing %s to %s and writing the changes to %s\n", oldpath, newpath, *file)
+        }
+        display.WriteHeader()
+    }
+    if err := out.WriteHeader(); err != nil {
+        panic(err)
+    }
+
+    // Close the databases safely if we get interrupted (checked between changes, the same as the dump)
+    interrupt := make(chan os.Signal, 1)
+    signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+    // Stats
+    var created, spent, unchanged int
+    var createdAmount, spentAmount int64
+
+    // Merge join - step through both inputs in order, moving on whichever side has the lower coin
+    var readErr error
+    if readErr = before.next(); readErr == nil {
+        readErr = after.next()
+    }
+    count := 0
+    interrupted := false
+    for readErr == nil && (before.coin != nil || after.coin != nil) {
+        select {
+        case <-interrupt:
+            interrupted = true
+        default:
+        }
+        if interrupted {
+            break
+        }
+
+        change, coin, side := "", before.coin, before
+        switch {
+        case after.coin == nil:
+            change = "spent"
+        case before.coin == nil:
+            change, coin, side = "created", after.coin, after
+        default:
+            switch compareOutpoints(before.coin.TxID, before.coin.Vout, after.coin.TxID, after.coin.Vout) {
+            case -1: // only in old
+                change = "spent"
+            case 1: // only in new
+                change, coin, side = "created", after.coin, after
+            default: // in both
+                unchanged++
+                if readErr = before.next(); readErr == nil {
+                    readErr = after.next()
+                }
+                continue
+            }
+        }
+
+        count++
+        if change == "created" {
+            created++
+            createdAmount += coin.Amount
+        } else {
+            spent++
+            spentAmount += coin.Amount
+        }
+        if ! *quiet {
+            if *verbose {
+                display.WriteChange(change, count, coin)
+            } else if count % 100000 == 0 {
+                fmt.Fprintf(console, "%d changes found\n", count)
+            }
+        }
+        if err := out.WriteChange(change, count, coin); err != nil {
+            panic(err)
+        }
+
+        readErr = side.next()
+    }
+    if interrupted {
+        signal.Stop(interrupt)
+        if ! *quiet {
+            fmt.Fprintln(console, "Interrupt signal caught. Shutting down gracefully.")
+        }
+        output.Close()
+        before.iter.Close()
+        after.iter.Close()
+        os.Exit(130) // the diff isn't complete
+    }
+    if readErr != nil { // stop here, as a partial diff would look the same as a complete one
+        fmt.Fprintln(console, "Couldn't compare the utxos.")
+        fmt.Fprintln(console, readErr)
+        output.Close()
+        before.iter.Close() // deferred calls don't run with os.Exit
+        after.iter.Close()
+        os.Exit(1)
+    }
+    if err := output.Close(); err != nil {
+        panic(err)
+    }
+
+    // Final Report
+    if ! *quiet {
+        fmt.Fprintln(console)
+        fmt.Fprintf(console, "Created:   %d\n", created)
+        fmt.Fprintf(console, "Spent:     %d\n", spent)
+        fmt.Fprintf(console, "Unchanged: %d\n", unchanged)
+        if fieldsSelected["amount"] {
+            fmt.Fprintf(console, "Created BTC: %s\n", formatBTC(createdAmount))
+            fmt.Fprintf(console, "Spent BTC:   %s\n", formatBTC(spentAmount))
+            fmt.Fprintf(console, "Net BTC:     %s\n", formatBTC(createdAmount - spentAmount))
+        }
+    }
+}
+
+// formatBTC formats an amount of satoshis as BTC with 8 decimal places (without going through a float, so it's exact)
+func formatBTC(satoshis int64) string {
+    sign := ""
+    if satoshis < 0 {
+        sign, satoshis = "-", -satoshis
+    }
+    return fmt.Sprintf("%s%d.%08d", sign, satoshis / 100000000, satoshis % 100000000)
+}
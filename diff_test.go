@@ -0,0 +1,78 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bytes"
+import "path/filepath"
+import "testing"
+
+func TestCompareOutpoints(t *testing.T) {
+    a := bytes.Repeat([]byte{0x11}, 32)
+    b := append(bytes.Repeat([]byte{0x11}, 31), 0x22) // bigger in the last byte (the first byte of the key)
+    c := append([]byte{0x22}, bytes.Repeat([]byte{0x11}, 31)...)
+
+    tests := []struct {
+        txidA []byte
+        voutA int64
+        txidB []byte
+        voutB int64
+        want  int
+    }{
+        {a, 0, a, 0, 0},
+        {a, 0, a, 1, -1},
+        {a, 127, a, 128, -1},
+        {a, 255, a, 16512, -1}, // 80 7f < 80 80 00
+        {a, 16512, a, 256, -1}, // 80 80 00 < 81 00
+        {a, 16511, a, 16512, 1}, // ff 7f > 80 80 00
+        {a, 16512, a, 16512, 0},
+        {a, 99999, b, 0, -1},
+        {c, 0, b, 0, -1}, // compared from the last byte of the txid
+        {b, 0, c, 0, 1},
+    }
+    for _, test := range tests {
+        if got := compareOutpoints(test.txidA, test.voutA, test.txidB, test.voutB); got != test.want {
+            t.Errorf("%x..%x:%d vs %x..%x:%d: got %d, want %d", test.txidA[0], test.txidA[31], test.voutA, test.txidB[0], test.txidB[31], test.voutB, got, test.want)
+        }
+    }
+}
+
+// TestDiffSideOrder reads a chainstate with vouts that aren't in numeric order in the keys, which still have to pass the order check
+func TestDiffSideOrder(t *testing.T) {
+    txid := bytes.Repeat([]byte{0x33}, 32)
+    var coins []chainstate.Coin
+    for _, vout := range []int64{0, 255, 256, 16512, 16600} {
+        coins = append(coins, chainstate.Coin{TxID: txid, Vout: vout, Amount: 1000, NSize: 0, Script: make([]byte, 20)})
+    }
+    folder := filepath.Join(t.TempDir(), "chainstate")
+    if err := writeTestChainstate(folder, coins); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, workers := range []int{1, 4} {
+        iter, _, err := openChainstate(folder, &chainstate.Options{NoAddress: true}, workers, true)
+        if err != nil {
+            t.Fatal(err)
+        }
+        side := &diffSide{name: folder, iter: iter}
+        var vouts []int64
+        for {
+            if err := side.next(); err != nil {
+                t.Fatalf("%d workers: %v", workers, err)
+            }
+            if side.coin == nil {
+                break
+            }
+            vouts = append(vouts, side.coin.Vout)
+        }
+        iter.Close()
+
+        want := []int64{0, 255, 16512, 16600, 256} // key order
+        if len(vouts) != len(want) {
+            t.Fatalf("%d workers: got vouts %v, want %v", workers, vouts, want)
+        }
+        for i := range want {
+            if vouts[i] != want[i] {
+                t.Fatalf("%d workers: got vouts %v, want %v", workers, vouts, want)
+            }
+        }
+    }
+}
@@ -0,0 +1,456 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "encoding/json" // quoting strings in json lines
+import "fmt"
+import "io"
+import "strconv" // formatting numbers
+import "strings"
+
+// Fields that can be selected with the -f flag
+var fieldsAllowed = []string{"count", "txid", "vout", "height", "coinbase", "amount", "nsize", "script", "scriptpubkey", "asm", "type", "address", "ms_m", "ms_n", "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses", "payload", "protocol"}
+
+// multisigFields are the fields with the details of p2ms scripts (they're empty for other types of script)
+var multisigFields = []string{"ms_m", "ms_n", "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses"}
+
+// multisigNeeded reports whether any of the multisig fields are used (so the p2ms scripts need decoding)
+func multisigNeeded(fieldsDecoded map[string]bool) bool {
+    for _, field := range multisigFields {
+        if fieldsDecoded[field] {
+            return true
+        }
+    }
+    return false
+}
+
+// valueNeeded reports whether any of the fields come from the value (the key only has the txid and vout, so the value doesn't need decoding for those)
+func valueNeeded(fieldsDecoded map[string]bool) bool {
+    for field, ok := range fieldsDecoded {
+        if ok && field != "count" && field != "txid" && field != "vout" {
+            return true
+        }
+    }
+    return false
+}
+
+// Output formats that can be selected with the -format flag
+var formatsAllowed = []string{"csv", "jsonl", "parquet", "sqlite", "pgcopy", "txoutset"}
+
+// recordWriter writes each utxo to the output in a particular format
+type recordWriter interface {
+    WriteHeader() error                                // called once before the first record
+    WriteRecord(count int, coin *chainstate.Coin) error // called for every utxo
+    Close() error                                      // called after the last record (does not close the underlying writer)
+}
+
+// formatOptions are settings for particular output formats
+type formatOptions struct {
+    rowGroupSize  int    // parquet: number of rows in each row group
+    file          string // sqlite: database file to create
+    sqliteIndexes bool   // sqlite: build indexes at the end
+    snapshot      string // pgcopy: snapshot id to write as the first column
+    network       string // txoutset: network the snapshot is for (main, test, testnet4, signet, regtest)
+    bestBlock     []byte // hash of the block the utxos are up to (txoutset base block, and metadata for parquet, sqlite and shard manifests)
+}
+
+// checkFormat makes sure the format and its options are usable before we start
+func checkFormat(format string, options *formatOptions) error {
+    for _, v := range formatsAllowed {
+        if v == format {
+            if format == "parquet" && options.rowGroupSize < 1 {
+                return fmt.Errorf("parquet row group size must be at least 1")
+            }
+            if format == "txoutset" {
+                if _, err := chainstate.NetworkMagic(options.network); err != nil {
+                    return fmt.Errorf("%v for the snapshot. Choose from the following: main,test,testnet4,signet,regtest", err)
+                }
+            }
+            return nil
+        }
+    }
+    return fmt.Errorf("'%s' is not a format you can use for the output. Choose from the following: %s", format, strings.Join(formatsAllowed, ","))
+}
+
+// newRecordWriter returns a recordWriter for the format that writes the selected fields to w (database formats write to options.file instead)
+func newRecordWriter(format string, w io.Writer, fields []string, options *formatOptions) (recordWriter, error) {
+    switch format {
+    case "csv":
+        return newCSVWriter(w, fields), nil
+    case "jsonl":
+        return newJSONLWriter(w, fields), nil
+    case "parquet":
+        return newParquetWriter(w, fields, options.rowGroupSize, options.bestBlock), nil
+    case "sqlite":
+        return newSQLiteWriter(options.file, fields, options.sqliteIndexes, options.bestBlock)
+    case "pgcopy":
+        return newPgcopyWriter(w, fields, options.snapshot), nil
+    case "txoutset":
+        return newTxoutsetWriter(w, options.network, options.bestBlock)
+    }
+    return nil, checkFormat(format, options)
+}
+
+// multiRecordWriter writes every record to more than one recordWriter (e.g. the dump and the rich list)
+type multiRecordWriter []recordWriter
+
+func (m multiRecordWriter) WriteHeader() error {
+    for _, w := range m {
+        if err := w.WriteHeader(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (m multiRecordWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    for _, w := range m {
+        if err := w.WriteRecord(count, coin); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (m multiRecordWriter) Close() error {
+    var first error
+    for _, w := range m { // close them all, even if one fails
+        if err := w.Close(); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
+
+// isDatabaseFormat reports whether a format writes to its own database file (rather than a stream of bytes)
+func isDatabaseFormat(format string) bool {
+    return format == "sqlite"
+}
+
+// isTextFormat reports whether a format is human-readable (so it can also be printed to the terminal)
+func isTextFormat(format string) bool {
+    return format == "csv" || format == "jsonl" || format == "pgcopy"
+}
+
+// fieldID identifies a field, so the writers only have to look up the field names once (not for every utxo)
+type fieldID int
+
+const (
+    fieldNone fieldID = iota // not a field (writes nothing)
+    fieldCount
+    fieldTxID
+    fieldVout
+    fieldHeight
+    fieldCoinbase
+    fieldAmount
+    fieldNSize
+    fieldScript
+    fieldScriptPubKey
+    fieldAsm
+    fieldType
+    fieldAddress
+    fieldMultisigM
+    fieldMultisigN
+    fieldMultisigPubKeys
+    fieldMultisigCompressed
+    fieldMultisigValid
+    fieldMultisigAddresses
+    fieldPayload
+    fieldProtocol
+)
+
+// fieldIDs are the ids for the names in fieldsAllowed
+var fieldIDs = map[string]fieldID{"count": fieldCount, "txid": fieldTxID, "vout": fieldVout, "height": fieldHeight, "coinbase": fieldCoinbase, "amount": fieldAmount, "nsize": fieldNSize, "script": fieldScript, "scriptpubkey": fieldScriptPubKey, "asm": fieldAsm, "type": fieldType, "address": fieldAddress,
+    "ms_m": fieldMultisigM, "ms_n": fieldMultisigN, "ms_pubkeys": fieldMultisigPubKeys, "ms_compressed": fieldMultisigCompressed, "ms_valid": fieldMultisigValid, "ms_addresses": fieldMultisigAddresses,
+    "payload": fieldPayload, "protocol": fieldProtocol}
+
+// fieldPlan works out the ids for a list of field names before the first utxo gets written
+func fieldPlan(fields []string) []fieldID {
+    plan := make([]fieldID, len(fields))
+    for i, v := range fields {
+        plan[i] = fieldIDs[v] // fieldNone if it isn't a field
+    }
+    return plan
+}
+
+// appendField appends a field as it appears in the csv
+func appendField(b []byte, id fieldID, count int, coin *chainstate.Coin) []byte {
+    switch id {
+    case fieldCount:
+        return strconv.AppendInt(b, int64(count), 10)
+    case fieldTxID:
+        return appendHex(b, coin.TxID)
+    case fieldVout:
+        return strconv.AppendInt(b, coin.Vout, 10)
+    case fieldHeight:
+        return strconv.AppendInt(b, coin.Height, 10)
+    case fieldCoinbase:
+        return appendBit(b, coin.Coinbase)
+    case fieldAmount:
+        return strconv.AppendInt(b, coin.Amount, 10)
+    case fieldNSize:
+        return strconv.AppendInt(b, coin.NSize, 10)
+    case fieldScript:
+        return appendHex(b, coin.Script)
+    case fieldScriptPubKey:
+        start := len(b)
+        return hexInPlace(chainstate.AppendScriptPubKey(b, coin.NSize, coin.Script), start)
+    case fieldAsm:
+        return appendAsm(b, coin)
+    case fieldType:
+        return append(b, coin.Type...)
+    case fieldAddress:
+        return append(b, coin.Address...)
+    case fieldPayload: // empty if it isn't nulldata
+        start := len(b)
+        return hexInPlace(chainstate.AppendPayload(b, coin.NSize, coin.Script), start)
+    case fieldProtocol:
+        return append(b, chainstate.Protocol(coin.NSize, coin.Script)...)
+    }
+
+    // Multisig fields (empty if it isn't a p2ms, and lists are separated by spaces)
+    //
+    //   ms_m  ms_n  ms_pubkeys                   ms_compressed  ms_valid  ms_addresses
+    //   1     2     02a1...  04b2...             1 0            1 1       1Abc... 1Def...
+    ms := coin.Multisig
+    if ms == nil || id < fieldMultisigM {
+        return b
+    }
+    switch id {
+    case fieldMultisigM:
+        return strconv.AppendInt(b, int64(ms.M), 10)
+    case fieldMultisigN:
+        return strconv.AppendInt(b, int64(len(ms.PubKeys)), 10)
+    }
+    for i := range ms.PubKeys {
+        if i > 0 {
+            b = append(b, ' ')
+        }
+        switch id {
+        case fieldMultisigPubKeys:
+            b = appendHex(b, ms.PubKeys[i])
+        case fieldMultisigCompressed:
+            b = appendBit(b, len(ms.PubKeys[i]) == 33)
+        case fieldMultisigValid:
+            b = appendBit(b, ms.Valid[i])
+        case fieldMultisigAddresses:
+            if i < len(ms.Addresses) {
+                b = append(b, ms.Addresses[i]...)
+            }
+        }
+    }
+    return b
+}
+
+// appendBit appends a boolean as 1 or 0
+func appendBit(b []byte, v bool) []byte {
+    if v {
+        return append(b, '1')
+    }
+    return append(b, '0')
+}
+
+// fieldString formats a field as a string (as it appears in the csv)
+func fieldString(field string, count int, coin *chainstate.Coin) string {
+    return string(appendField(nil, fieldIDs[field], count, coin))
+}
+
+// appendHex appends bytes as lowercase hexadecimal (without allocating a string like hex.EncodeToString)
+func appendHex(b []byte, v []byte) []byte {
+    const digits = "0123456789abcdef"
+    for _, c := range v {
+        b = append(b, digits[c>>4], digits[c&0x0f])
+    }
+    return b
+}
+
+// hexInPlace converts the bytes in b from start onwards to hexadecimal (so something can be built straight in to b and then converted, without a buffer in between)
+func hexInPlace(b []byte, start int) []byte {
+    const digits = "0123456789abcdef"
+    n := len(b) - start
+    b = append(b, make([]byte, n)...) // each byte becomes two characters
+    for i := n - 1; i >= 0; i-- { // from the end, so nothing gets overwritten before it's converted
+        c := b[start+i]
+        b[start+2*i], b[start+2*i+1] = digits[c>>4], digits[c&0x0f]
+    }
+    return b
+}
+
+// appendAsm appends the disassembly of a coin's scriptpubkey. The scriptpubkey is built on the end of b first, then replaced with the disassembly (so it doesn't need a buffer of its own).
+func appendAsm(b []byte, coin *chainstate.Coin) []byte {
+    start := len(b)
+    b = chainstate.AppendScriptPubKey(b, coin.NSize, coin.Script)
+    end := len(b)
+    b = chainstate.AppendAsm(b, b[start:end])
+    return b[:start+copy(b[start:], b[end:])]
+}
+
+// fieldAppender appends the selected fields of a utxo to a line (so another writer can add to the line, e.g. the diff)
+type fieldAppender interface {
+    appendFields(line []byte, count int, coin *chainstate.Coin) []byte
+}
+
+// csvWriter writes comma-separated lines with a header line of field names
+//
+//   count,txid,vout,amount,type,address
+//   1,033e83e3204b0cc28724e147f6fd140529b2537249f9c61c9de9972750030000,0,65279,p2pkh,1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX
+//
+// Each line is appended to a buffer that gets reused, so writing a record doesn't allocate.
+type csvWriter struct {
+    w      io.Writer
+    fields []string
+    plan   []fieldID
+    line   []byte
+}
+
+func newCSVWriter(w io.Writer, fields []string) *csvWriter {
+    return &csvWriter{w: w, fields: fields, plan: fieldPlan(fields)}
+}
+
+func (c *csvWriter) WriteHeader() error {
+    _, err := fmt.Fprintln(c.w, strings.Join(c.fields, ",")) // count,txid,vout,
+    return err
+}
+
+func (c *csvWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    c.line = append(c.appendFields(c.line[:0], count, coin), '\n')
+    _, err := c.w.Write(c.line)
+    return err
+}
+
+func (c *csvWriter) appendFields(line []byte, count int, coin *chainstate.Coin) []byte {
+    for i, id := range c.plan {
+        if i > 0 {
+            line = append(line, ',')
+        }
+        line = appendField(line, id, count, coin)
+    }
+    return line
+}
+
+func (c *csvWriter) Close() error {
+    return nil
+}
+
+// jsonlWriter writes one json object per line, with numbers for count/vout/height/amount/nsize, a boolean for coinbase, and null for a missing address
+//
+//   {"count":1,"txid":"033e83e3204b0cc28724e147f6fd140529b2537249f9c61c9de9972750030000","vout":0,"amount":65279,"type":"p2pkh","address":"1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX"}
+type jsonlWriter struct {
+    w     io.Writer
+    plan  []fieldID
+    names [][]byte // "name": for each field
+    line  []byte
+}
+
+func newJSONLWriter(w io.Writer, fields []string) *jsonlWriter {
+    j := &jsonlWriter{w: w, plan: fieldPlan(fields)}
+    for _, v := range fields {
+        j.names = append(j.names, append(strconv.AppendQuote(nil, v), ':'))
+    }
+    return j
+}
+
+func (j *jsonlWriter) WriteHeader() error {
+    return nil // every line describes itself
+}
+
+func (j *jsonlWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    line := append(j.line[:0], '{')
+    line = j.appendFields(line, count, coin)
+    j.line = append(line, '}', '\n')
+
+    _, err := j.w.Write(j.line)
+    return err
+}
+
+// appendFields appends the "name":value pairs (without the braces)
+func (j *jsonlWriter) appendFields(line []byte, count int, coin *chainstate.Coin) []byte {
+    for i, id := range j.plan {
+        if i > 0 {
+            line = append(line, ',')
+        }
+        line = append(line, j.names[i]...)
+        line = appendJSONValue(line, id, count, coin)
+    }
+    return line
+}
+
+func (j *jsonlWriter) Close() error {
+    return nil
+}
+
+// appendJSONValue appends a field as a json value
+func appendJSONValue(line []byte, id fieldID, count int, coin *chainstate.Coin) []byte {
+    switch id {
+    case fieldCount, fieldVout, fieldHeight, fieldAmount, fieldNSize: // numbers
+        return appendField(line, id, count, coin)
+    case fieldCoinbase: // boolean
+        return strconv.AppendBool(line, coin.Coinbase)
+    case fieldAddress: // null if there isn't one
+        if coin.Address == "" {
+            return append(line, "null"...)
+        }
+        return appendJSONString(line, coin.Address)
+    case fieldTxID, fieldScript, fieldScriptPubKey, fieldAsm: // hex and opcode names never need escaping
+        line = append(line, '"')
+        line = appendField(line, id, count, coin)
+        return append(line, '"')
+    case fieldType:
+        return appendJSONString(line, coin.Type)
+    case fieldPayload, fieldProtocol: // null if it isn't nulldata (or it's not a protocol we know)
+        if coin.Type != "nulldata" || (id == fieldProtocol && chainstate.Protocol(coin.NSize, coin.Script) == "") {
+            return append(line, "null"...)
+        }
+        line = append(line, '"')
+        line = appendField(line, id, count, coin)
+        return append(line, '"')
+    }
+
+    // Multisig fields (null if it isn't a p2ms, and lists are arrays)
+    ms := coin.Multisig
+    if id < fieldMultisigM {
+        return line
+    }
+    if ms == nil {
+        return append(line, "null"...)
+    }
+    switch id {
+    case fieldMultisigM, fieldMultisigN:
+        return appendField(line, id, count, coin)
+    }
+    line = append(line, '[')
+    for i := range ms.PubKeys {
+        if i > 0 {
+            line = append(line, ',')
+        }
+        switch id {
+        case fieldMultisigPubKeys:
+            line = append(line, '"')
+            line = appendHex(line, ms.PubKeys[i])
+            line = append(line, '"')
+        case fieldMultisigCompressed:
+            line = strconv.AppendBool(line, len(ms.PubKeys[i]) == 33)
+        case fieldMultisigValid:
+            line = strconv.AppendBool(line, ms.Valid[i])
+        case fieldMultisigAddresses:
+            if i < len(ms.Addresses) {
+                line = appendJSONString(line, ms.Addresses[i])
+            } else {
+                line = append(line, "null"...)
+            }
+        }
+    }
+    return append(line, ']')
+}
+
+// appendJSONString appends a string to a byte slice as a quoted and escaped json string
+func appendJSONString(b []byte, s string) []byte {
+    for i := 0; i < len(s); i++ {
+        if c := s[i]; c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' { // needs escaping (the same way as encoding/json)
+            quoted, _ := json.Marshal(s) // marshalling a string never fails
+            return append(b, quoted...)
+        }
+    }
+    b = append(b, '"')
+    b = append(b, s...)
+    return append(b, '"')
+}
@@ -0,0 +1,77 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "os"
+
+// coinIterator steps through the utxos from an input (the chainstate leveldb or a dumptxoutset snapshot file)
+type coinIterator interface {
+    Next() bool
+    Coin() *chainstate.Coin // only valid until the next call to Next
+    Err() error
+    Close() error
+}
+
+var _ coinIterator = (*chainstate.Iterator)(nil)
+var _ coinIterator = (*chainstate.SnapshotReader)(nil)
+var _ coinIterator = (*chainstate.ParallelIterator)(nil)
+
+// openChainstate opens a chainstate folder, reading and decoding it on several goroutines if there's more than one worker (ordered keeps the coins in key order)
+func openChainstate(folder string, options *chainstate.Options, workers int, ordered bool) (coinIterator, chainstate.Metadata, error) {
+    if workers > 1 {
+        ranges := workers
+        if ranges > 256 {
+            ranges = 256
+        }
+        p, err := chainstate.OpenParallel(folder, options, chainstate.ParallelOptions{Ranges: ranges, Workers: workers, Ordered: ordered})
+        if err != nil {
+            return nil, chainstate.Metadata{}, err
+        }
+        return p, p.Metadata, nil
+    }
+    db, err := chainstate.Open(folder, options)
+    if err != nil {
+        return nil, chainstate.Metadata{}, err
+    }
+    return db, db.Metadata, nil
+}
+
+// snapshotNetwork gets the network a snapshot file is for from its header (main if it doesn't say)
+func snapshotNetwork(file string) (string, error) {
+    s, err := chainstate.OpenSnapshot(file, nil)
+    if err != nil {
+        return "", err
+    }
+    defer s.Close()
+    if network := s.Metadata.Network(); network != "" {
+        return network, nil
+    }
+    return "main", nil
+}
+
+// openInput opens a chainstate folder or a snapshot file, and returns an iterator over its coins (in key order) and the hash of the block they're up to (nil if it isn't known)
+func openInput(path string, options *chainstate.Options, workers int) (coinIterator, []byte, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, nil, err
+    }
+    if info.IsDir() {
+        db, metadata, err := openChainstate(path, options, workers, true)
+        if err != nil {
+            return nil, nil, err
+        }
+        return db, metadata.BestBlock, nil
+    }
+    snapshot, err := chainstate.OpenSnapshot(path, options)
+    if err != nil {
+        return nil, nil, err
+    }
+    return snapshot, snapshot.Metadata.BaseBlockHash, nil
+}
+
+// inputNetwork gets the network of a chainstate folder (from its path) or a snapshot file (from its header)
+func inputNetwork(path string) (string, error) {
+    if info, err := os.Stat(path); err == nil && !info.IsDir() {
+        return snapshotNetwork(path)
+    }
+    return networkFromPath(path), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import "bufio" // bulk writing to file
+import "crypto/sha256" // checksum of the file
+import "encoding/hex"
+import "fmt"
+import "hash"
+import "io"
+import "os"
+
+// outputFile is a file that results get written to (through compression and a buffer). It keeps track of how much has been written and the checksum of the file.
+//
+//   results -> bufio -> compressor -> file
+//                                  -> sha256
+type outputFile struct {
+    name       string
+    f          *os.File
+    compressor io.WriteCloser // nil if not compressing
+    writer     *bufio.Writer
+    hash       hash.Hash // sha256 of the bytes written to the file (after compression)
+    size       int64     // bytes written before compression
+}
+
+// createOutputFile creates (or truncates) a file to write results to. A name of "-" writes to stdout.
+func createOutputFile(name string, compression string) (*outputFile, error) {
+    o := &outputFile{name: name, hash: sha256.New()}
+
+    if name == "-" {
+        o.f = os.Stdout // -o - writes to stdout
+    } else {
+        f, err := os.Create(name) // os.OpenFile("filename.txt", os.O_APPEND, 0666)
+        if err != nil {
+            return nil, err
+        }
+        o.f = f
+    }
+
+    // Compress everything on its way to the file (using all the cpus so it keeps up with reading the database)
+    var w io.Writer = io.MultiWriter(o.f, o.hash)
+    if compression != "none" {
+        compressor, err := newCompressor(compression, w)
+        if err != nil {
+            o.f.Close()
+            return nil, err
+        }
+        o.compressor = compressor
+        w = compressor
+    }
+
+    // Create file buffer to speed up writing to the file.
+    o.writer = bufio.NewWriter(w)
+
+    return o, nil
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+    n, err := o.writer.Write(p)
+    o.size += int64(n)
+    return n, err
+}
+
+// WriteAt overwrites bytes that have already been written (e.g. to fill in a count in a header). It only works for uncompressed files.
+func (o *outputFile) WriteAt(p []byte, off int64) (int, error) {
+    if o.compressor != nil || o.f == os.Stdout {
+        return 0, fmt.Errorf("can't go back and change %s (it's compressed or stdout)", o.name)
+    }
+    if err := o.writer.Flush(); err != nil {
+        return 0, err
+    }
+    return o.f.WriteAt(p, off)
+}
+
+// Close flushes the bufio buffer, finishes compressing, and closes the file
+func (o *outputFile) Close() error {
+    err := o.writer.Flush()
+    if o.compressor != nil {
+        if cerr := o.compressor.Close(); err == nil {
+            err = cerr
+        }
+    }
+    if o.f != os.Stdout {
+        if cerr := o.f.Close(); err == nil {
+            err = cerr
+        }
+    }
+    return err
+}
+
+// Checksum is the sha256 of the file (only complete after the file has been closed)
+func (o *outputFile) Checksum() string {
+    return hex.EncodeToString(o.hash.Sum(nil))
+}
@@ -0,0 +1,596 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "github.com/golang/snappy" // page compression (already used by leveldb)
+import "encoding/binary" // little-endian plain encoding
+import "encoding/hex"
+import "io"
+
+// Apache Parquet output
+//
+// Each selected field is written as a typed column. Rows are buffered until there are enough for a row group,
+// then each column is written out as (snappy compressed) pages of about 1MB, so memory stays bounded no matter how big the chainstate is.
+// The file metadata at the end is encoded with the thrift compact protocol.
+//
+//   PAR1 <row group 1> <row group 2> ... <file metadata> <metadata length> PAR1
+//
+// https://github.com/apache/parquet-format
+
+// Parquet physical types
+const (
+    parquetBoolean   = 0
+    parquetInt32     = 1
+    parquetInt64     = 2
+    parquetByteArray = 6
+)
+
+// Parquet encodings, codecs and page types
+const (
+    encodingPlain           = 0
+    encodingPlainDictionary = 2
+    encodingRLE             = 3
+
+    codecSnappy = 1
+
+    pageData       = 0
+    pageDictionary = 2
+
+    convertedUTF8      = 0
+    repetitionRequired = 0
+    repetitionOptional = 1
+)
+
+// parquetColumn buffers the values of one field for the current row group
+type parquetColumn struct {
+    field      string
+    kind       int32 // physical type
+    utf8       bool  // byte array holds a string
+    optional   bool  // values can be null (written with definition levels)
+    dictionary bool  // dictionary encoded (for columns with only a few different values)
+
+    values  []byte // plain encoded values
+    bools   []bool // boolean values (bit-packed when the page is written)
+    defined []bool // definition levels (optional columns only)
+    indices []int  // dictionary indices (dictionary columns only)
+
+    dict       map[string]int // dictionary value -> index
+    dictValues []string       // dictionary values in index order
+}
+
+// parquetPageSize is roughly the most bytes in a data page (before compression)
+const parquetPageSize = 1 << 20
+
+// plainSize is the size of the plain encoded value at offset in c.values (0 for the columns that don't keep their values there)
+func (c *parquetColumn) plainSize(offset int) int {
+    switch {
+    case c.dictionary || c.kind == parquetBoolean:
+        return 0
+    case c.kind == parquetInt32:
+        return 4
+    case c.kind == parquetInt64:
+        return 8
+    }
+    return 4 + int(binary.LittleEndian.Uint32(c.values[offset:])) // byte array (length first)
+}
+
+// parquetWriter writes the selected fields to a parquet file
+type parquetWriter struct {
+    w            io.Writer
+    columns      []*parquetColumn
+    rowGroupSize int // rows per row group
+    rows         int // rows in the current row group
+    totalRows    int64
+    offset       int64 // bytes written so far
+    rowGroups    []parquetRowGroup
+    bestBlock    []byte // stored in the key-value metadata (if there is one)
+}
+
+// parquetRowGroup is what we need to remember about each row group for the file metadata
+type parquetRowGroup struct {
+    chunks    []parquetChunk
+    numRows   int64
+    totalSize int64
+}
+
+// parquetChunk is the metadata for one column in a row group
+type parquetChunk struct {
+    column           *parquetColumn
+    dataOffset       int64
+    dictionaryOffset int64 // -1 if there's no dictionary page
+    uncompressedSize int64
+    compressedSize   int64
+    numValues        int64
+}
+
+func newParquetWriter(w io.Writer, fields []string, rowGroupSize int, bestBlock []byte) *parquetWriter {
+    p := &parquetWriter{w: w, rowGroupSize: rowGroupSize, bestBlock: bestBlock}
+    for _, field := range fields {
+        c := &parquetColumn{field: field}
+        switch field {
+        case "count", "amount":
+            c.kind = parquetInt64
+        case "vout", "height", "nsize":
+            c.kind = parquetInt32
+        case "coinbase":
+            c.kind = parquetBoolean
+        case "script", "scriptpubkey":
+            c.kind = parquetByteArray
+        case "txid", "asm":
+            c.kind, c.utf8 = parquetByteArray, true
+        case "type":
+            c.kind, c.utf8, c.dictionary = parquetByteArray, true, true
+            c.dict = map[string]int{}
+        case "address":
+            c.kind, c.utf8, c.optional = parquetByteArray, true, true
+        case "ms_m", "ms_n":
+            c.kind, c.optional = parquetInt32, true
+        case "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses": // space-separated lists, the same as the csv
+            c.kind, c.utf8, c.optional = parquetByteArray, true, true
+        case "payload":
+            c.kind, c.optional = parquetByteArray, true
+        case "protocol":
+            c.kind, c.utf8, c.optional = parquetByteArray, true, true
+        }
+        p.columns = append(p.columns, c)
+    }
+    return p
+}
+
+func (p *parquetWriter) WriteHeader() error {
+    return p.write([]byte("PAR1")) // magic number
+}
+
+func (p *parquetWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    for _, c := range p.columns {
+        switch c.field {
+        case "count":
+            c.values = binary.LittleEndian.AppendUint64(c.values, uint64(count))
+        case "txid":
+            start := len(c.values) // hex built straight in to the column after its length
+            c.values = appendHex(append(c.values, 0, 0, 0, 0), coin.TxID)
+            binary.LittleEndian.PutUint32(c.values[start:], uint32(len(c.values)-start-4))
+        case "vout":
+            c.values = binary.LittleEndian.AppendUint32(c.values, uint32(coin.Vout))
+        case "height":
+            c.values = binary.LittleEndian.AppendUint32(c.values, uint32(coin.Height))
+        case "coinbase":
+            c.bools = append(c.bools, coin.Coinbase)
+        case "amount":
+            c.values = binary.LittleEndian.AppendUint64(c.values, uint64(coin.Amount))
+        case "nsize":
+            c.values = binary.LittleEndian.AppendUint32(c.values, uint32(coin.NSize))
+        case "script":
+            c.values = appendByteArray(c.values, coin.Script)
+        case "scriptpubkey": // built straight in to the column after its length
+            start := len(c.values)
+            c.values = chainstate.AppendScriptPubKey(append(c.values, 0, 0, 0, 0), coin.NSize, coin.Script)
+            binary.LittleEndian.PutUint32(c.values[start:], uint32(len(c.values)-start-4))
+        case "asm": // the same
+            start := len(c.values)
+            c.values = appendAsm(append(c.values, 0, 0, 0, 0), coin)
+            binary.LittleEndian.PutUint32(c.values[start:], uint32(len(c.values)-start-4))
+        case "type":
+            index, ok := c.dict[coin.Type]
+            if !ok {
+                index = len(c.dictValues)
+                c.dict[coin.Type] = index
+                c.dictValues = append(c.dictValues, coin.Type)
+            }
+            c.indices = append(c.indices, index)
+        case "address":
+            c.defined = append(c.defined, coin.Address != "")
+            if coin.Address != "" { // nulls are only recorded in the definition levels
+                c.values = appendByteArrayString(c.values, coin.Address)
+            }
+        case "ms_m", "ms_n": // null if it's not a p2ms
+            c.defined = append(c.defined, coin.Multisig != nil)
+            if coin.Multisig != nil {
+                n := coin.Multisig.M
+                if c.field == "ms_n" {
+                    n = len(coin.Multisig.PubKeys)
+                }
+                c.values = binary.LittleEndian.AppendUint32(c.values, uint32(n))
+            }
+        case "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses":
+            c.defined = append(c.defined, coin.Multisig != nil)
+            if coin.Multisig != nil {
+                start := len(c.values)
+                c.values = appendField(append(c.values, 0, 0, 0, 0), fieldIDs[c.field], count, coin)
+                binary.LittleEndian.PutUint32(c.values[start:], uint32(len(c.values)-start-4))
+            }
+        case "payload": // null if it isn't nulldata (built in to the column like the scriptpubkey)
+            c.defined = append(c.defined, coin.Type == "nulldata")
+            if coin.Type == "nulldata" {
+                start := len(c.values)
+                c.values = chainstate.AppendPayload(append(c.values, 0, 0, 0, 0), coin.NSize, coin.Script)
+                binary.LittleEndian.PutUint32(c.values[start:], uint32(len(c.values)-start-4))
+            }
+        case "protocol": // null if it's not one we know
+            protocol := chainstate.Protocol(coin.NSize, coin.Script)
+            c.defined = append(c.defined, protocol != "")
+            if protocol != "" {
+                c.values = appendByteArrayString(c.values, protocol)
+            }
+        }
+    }
+
+    p.rows++
+    if p.rows >= p.rowGroupSize {
+        return p.flushRowGroup()
+    }
+    return nil
+}
+
+// Close writes the last row group and the file metadata
+func (p *parquetWriter) Close() error {
+    if p.rows > 0 {
+        if err := p.flushRowGroup(); err != nil {
+            return err
+        }
+    }
+
+    metadata := p.fileMetadata()
+    footer := binary.LittleEndian.AppendUint32(metadata, uint32(len(metadata))) // metadata length
+    footer = append(footer, "PAR1"...)
+    return p.write(footer)
+}
+
+func (p *parquetWriter) write(b []byte) error {
+    n, err := p.w.Write(b)
+    p.offset += int64(n)
+    return err
+}
+
+// flushRowGroup writes a column chunk (a dictionary page if it has one, and then the data pages) for every column and resets the buffers
+func (p *parquetWriter) flushRowGroup() error {
+    rowGroup := parquetRowGroup{numRows: int64(p.rows)}
+
+    for _, c := range p.columns {
+        chunk := parquetChunk{column: c, dictionaryOffset: -1, numValues: int64(p.rows)}
+
+        // Dictionary page (plain encoded dictionary values)
+        if c.dictionary {
+            var dict []byte
+            for _, v := range c.dictValues {
+                dict = appendByteArray(dict, []byte(v))
+            }
+            chunk.dictionaryOffset = p.offset
+            uncompressed, compressed, err := p.writePage(pageDictionary, dict, len(c.dictValues), encodingPlainDictionary)
+            if err != nil {
+                return err
+            }
+            chunk.uncompressedSize += uncompressed
+            chunk.compressedSize += compressed
+        }
+
+        // Data pages: [definition levels] values
+        //
+        // A row group can be a lot bigger than a page is allowed to be (page sizes are int32s), so the rows are split in to pages of about parquetPageSize bytes:
+        //
+        //   rows    [start ............ end) [end ...
+        //   values  [value ......... values) (nulls don't have a value)
+        //   bytes   [offset ......... next)  (where the plain encoded values are in c.values)
+        chunk.dataOffset = p.offset
+        value, offset := 0, 0
+        for start := 0; start < p.rows; {
+            end, values, next := start, value, offset
+            for end < p.rows && (end == start || next-offset+end-start < parquetPageSize) { // (about a byte a row for the levels, indices and booleans)
+                if !c.optional || c.defined[end] {
+                    next += c.plainSize(next)
+                    values++
+                }
+                end++
+            }
+
+            var page []byte
+            if c.optional {
+                levels := appendRLE(nil, c.defined[start:end], 1)
+                page = binary.LittleEndian.AppendUint32(page, uint32(len(levels))) // definition levels are prefixed with their length
+                page = append(page, levels...)
+            }
+            encoding := int32(encodingPlain)
+            switch {
+            case c.dictionary:
+                encoding = encodingPlainDictionary
+                width := bitWidth(len(c.dictValues) - 1)
+                if width == 0 {
+                    width = 1 // some readers don't like a bit width of zero
+                }
+                page = append(page, byte(width))
+                page = appendRLEInts(page, c.indices[value:values], width)
+            case c.kind == parquetBoolean:
+                page = appendBitPacked(page, c.bools[value:values])
+            default:
+                page = append(page, c.values[offset:next]...)
+            }
+            uncompressed, compressed, err := p.writePage(pageData, page, end-start, encoding)
+            if err != nil {
+                return err
+            }
+            chunk.uncompressedSize += uncompressed
+            chunk.compressedSize += compressed
+
+            start, value, offset = end, values, next
+        }
+
+        rowGroup.chunks = append(rowGroup.chunks, chunk)
+        rowGroup.totalSize += chunk.uncompressedSize
+
+        // Reset buffers (keep the dictionary map, but start a new dictionary for the next row group)
+        c.values, c.bools, c.defined, c.indices = c.values[:0], c.bools[:0], c.defined[:0], c.indices[:0]
+        if c.dictionary {
+            c.dict = map[string]int{}
+            c.dictValues = nil
+        }
+    }
+
+    p.rowGroups = append(p.rowGroups, rowGroup)
+    p.totalRows += int64(p.rows)
+    p.rows = 0
+    return nil
+}
+
+// writePage compresses a page and writes it with its header. Returns the uncompressed and compressed sizes (including the header).
+func (p *parquetWriter) writePage(pageType int32, data []byte, numValues int, encoding int32) (int64, int64, error) {
+    compressed := snappy.Encode(nil, data)
+
+    t := &thriftWriter{}
+    t.i32(1, pageType)
+    t.i32(2, int32(len(data)))
+    t.i32(3, int32(len(compressed)))
+    if pageType == pageDictionary {
+        t.beginStruct(7) // DictionaryPageHeader
+        t.i32(1, int32(numValues))
+        t.i32(2, encoding)
+        t.endStruct()
+    } else {
+        t.beginStruct(5) // DataPageHeader
+        t.i32(1, int32(numValues))
+        t.i32(2, encoding)
+        t.i32(3, encodingRLE) // definition levels
+        t.i32(4, encodingRLE) // repetition levels
+        t.endStruct()
+    }
+    t.stop()
+
+    if err := p.write(t.buf); err != nil {
+        return 0, 0, err
+    }
+    if err := p.write(compressed); err != nil {
+        return 0, 0, err
+    }
+    return int64(len(t.buf) + len(data)), int64(len(t.buf) + len(compressed)), nil
+}
+
+// fileMetadata encodes the FileMetaData struct (schema, row groups, column chunk locations)
+func (p *parquetWriter) fileMetadata() []byte {
+    t := &thriftWriter{}
+    t.i32(1, 1) // version
+
+    // Schema (a root element followed by a flat list of columns)
+    t.listHeader(2, thriftStruct, len(p.columns)+1)
+    t.beginListStruct()
+    t.binary(4, []byte("schema"))
+    t.i32(5, int32(len(p.columns))) // num_children
+    t.endStruct()
+    for _, c := range p.columns {
+        t.beginListStruct()
+        t.i32(1, c.kind)
+        if c.optional {
+            t.i32(3, repetitionOptional)
+        } else {
+            t.i32(3, repetitionRequired)
+        }
+        t.binary(4, []byte(c.field))
+        if c.utf8 {
+            t.i32(6, convertedUTF8)
+        }
+        t.endStruct()
+    }
+
+    t.i64(3, p.totalRows) // num_rows
+
+    // Row groups
+    t.listHeader(4, thriftStruct, len(p.rowGroups))
+    for _, rg := range p.rowGroups {
+        t.beginListStruct()
+        t.listHeader(1, thriftStruct, len(rg.chunks)) // columns
+        for _, chunk := range rg.chunks {
+            t.beginListStruct()
+            fileOffset := chunk.dataOffset
+            if chunk.dictionaryOffset >= 0 {
+                fileOffset = chunk.dictionaryOffset
+            }
+            t.i64(2, fileOffset)
+
+            t.beginStruct(3) // ColumnMetaData
+            t.i32(1, chunk.column.kind)
+            if chunk.column.dictionary {
+                t.listHeader(2, thriftI32, 2) // encodings
+                t.listI32(encodingPlainDictionary)
+                t.listI32(encodingRLE)
+            } else {
+                t.listHeader(2, thriftI32, 2)
+                t.listI32(encodingPlain)
+                t.listI32(encodingRLE)
+            }
+            t.listHeader(3, thriftBinary, 1) // path_in_schema
+            t.listBinary([]byte(chunk.column.field))
+            t.i32(4, codecSnappy)
+            t.i64(5, chunk.numValues)
+            t.i64(6, chunk.uncompressedSize)
+            t.i64(7, chunk.compressedSize)
+            t.i64(9, chunk.dataOffset)
+            if chunk.dictionaryOffset >= 0 {
+                t.i64(11, chunk.dictionaryOffset)
+            }
+            t.endStruct()
+
+            t.endStruct()
+        }
+        t.i64(2, rg.totalSize) // total_byte_size
+        t.i64(3, rg.numRows)   // num_rows
+        t.endStruct()
+    }
+
+    // Key-value metadata
+    if p.bestBlock != nil {
+        t.listHeader(5, thriftStruct, 1)
+        t.beginListStruct()
+        t.binary(1, []byte("best_block"))
+        t.binary(2, []byte(hex.EncodeToString(p.bestBlock)))
+        t.endStruct()
+    }
+
+    t.binary(6, []byte("bitcoin-utxo-dump")) // created_by
+    t.stop()
+    return t.buf
+}
+
+// appendByteArray plain encodes a byte array (4-byte length followed by the bytes)
+func appendByteArray(b []byte, v []byte) []byte {
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+    return append(b, v...)
+}
+
+// appendByteArrayString is the same for a string (without converting it to a []byte first)
+func appendByteArrayString(b []byte, v string) []byte {
+    b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+    return append(b, v...)
+}
+
+// appendBitPacked plain encodes booleans (one bit each, least significant bit first)
+func appendBitPacked(b []byte, values []bool) []byte {
+    for i := 0; i < len(values); i += 8 {
+        var packed byte
+        for j := 0; j < 8 && i+j < len(values); j++ {
+            if values[i+j] {
+                packed |= 1 << uint(j)
+            }
+        }
+        b = append(b, packed)
+    }
+    return b
+}
+
+// appendRLE encodes booleans (definition levels) as RLE runs
+func appendRLE(b []byte, values []bool, width int) []byte {
+    ints := make([]int, len(values))
+    for i, v := range values {
+        if v {
+            ints[i] = 1
+        }
+    }
+    return appendRLEInts(b, ints, width)
+}
+
+// appendRLEInts encodes integers with the RLE/bit-packing hybrid encoding (using RLE runs only)
+//
+//   run = varint(length << 1) value (padded to a whole number of bytes)
+func appendRLEInts(b []byte, values []int, width int) []byte {
+    size := (width + 7) / 8 // bytes per value
+    for i := 0; i < len(values); {
+        j := i
+        for j < len(values) && values[j] == values[i] {
+            j++
+        }
+        b = binary.AppendUvarint(b, uint64(j-i) << 1)
+        for k := 0; k < size; k++ {
+            b = append(b, byte(values[i] >> uint(8*k)))
+        }
+        i = j
+    }
+    return b
+}
+
+// bitWidth is the number of bits needed to store a value
+func bitWidth(max int) int {
+    width := 0
+    for max > 0 {
+        width++
+        max >>= 1
+    }
+    return width
+}
+
+// Thrift compact protocol types
+const (
+    thriftI32       = 5
+    thriftI64       = 6
+    thriftBinary    = 8
+    thriftList      = 9
+    thriftStruct    = 12
+)
+
+// thriftWriter encodes structs with the thrift compact protocol (just enough for the parquet metadata)
+type thriftWriter struct {
+    buf    []byte
+    last   int16   // id of the last field written in the current struct (field ids are delta encoded)
+    parent []int16 // last field ids of the enclosing structs
+}
+
+func (t *thriftWriter) fieldHeader(id int16, kind byte) {
+    delta := id - t.last
+    if delta > 0 && delta <= 15 {
+        t.buf = append(t.buf, byte(delta) << 4 | kind)
+    } else {
+        t.buf = append(t.buf, kind)
+        t.buf = binary.AppendVarint(t.buf, int64(id)) // zigzag
+    }
+    t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+    t.fieldHeader(id, thriftI32)
+    t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+    t.fieldHeader(id, thriftI64)
+    t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) binary(id int16, v []byte) {
+    t.fieldHeader(id, thriftBinary)
+    t.listBinary(v)
+}
+
+func (t *thriftWriter) listHeader(id int16, kind byte, size int) {
+    t.fieldHeader(id, thriftList)
+    if size < 15 {
+        t.buf = append(t.buf, byte(size) << 4 | kind)
+    } else {
+        t.buf = append(t.buf, 0xf0 | kind)
+        t.buf = binary.AppendUvarint(t.buf, uint64(size))
+    }
+}
+
+func (t *thriftWriter) listI32(v int32) {
+    t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) listBinary(v []byte) {
+    t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+    t.buf = append(t.buf, v...)
+}
+
+// beginStruct starts a struct field, beginListStruct starts a struct inside a list
+func (t *thriftWriter) beginStruct(id int16) {
+    t.fieldHeader(id, thriftStruct)
+    t.beginListStruct()
+}
+
+func (t *thriftWriter) beginListStruct() {
+    t.parent = append(t.parent, t.last)
+    t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+    t.stop()
+    t.last = t.parent[len(t.parent)-1]
+    t.parent = t.parent[:len(t.parent)-1]
+}
+
+func (t *thriftWriter) stop() {
+    t.buf = append(t.buf, 0)
+}
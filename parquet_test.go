@@ -0,0 +1,354 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "github.com/golang/snappy"                                // page compression
+import "bytes"
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "reflect"
+import "testing"
+
+// A small parquet reader, just enough to read back what parquetWriter writes:
+//
+//   PAR1 [column chunk: [dictionary page] data page... ]... metadata len(metadata) PAR1
+//
+// The values come back as int64, bool, string (utf8 columns) or []byte, with nil for nulls.
+
+// thriftReader decodes the thrift compact protocol in to maps of field id to value
+type thriftReader struct {
+    b []byte
+    i int
+}
+
+func (r *thriftReader) byte() byte {
+    v := r.b[r.i]
+    r.i++
+    return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+    v, n := binary.Uvarint(r.b[r.i:])
+    r.i += n
+    return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+    v := r.uvarint()
+    return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(kind byte) interface{} {
+    switch kind {
+    case 1, 2: // bool (in a field header)
+        return kind == 1
+    case 3:
+        return int64(r.byte())
+    case thriftI32, thriftI64, 4:
+        return r.zigzag()
+    case thriftBinary:
+        n := int(r.uvarint())
+        r.i += n
+        return r.b[r.i-n : r.i]
+    case thriftList:
+        header := r.byte()
+        size, kind := int(header>>4), header&0x0f
+        if size == 15 {
+            size = int(r.uvarint())
+        }
+        list := make([]interface{}, size)
+        for i := range list {
+            list[i] = r.value(kind)
+        }
+        return list
+    case thriftStruct:
+        return r.structure()
+    }
+    panic(fmt.Sprintf("thrift type %d", kind))
+}
+
+func (r *thriftReader) structure() map[int]interface{} {
+    fields := map[int]interface{}{}
+    last := 0
+    for {
+        header := r.byte()
+        if header == 0 { // stop
+            return fields
+        }
+        id := last + int(header>>4)
+        if header>>4 == 0 {
+            id = int(r.zigzag())
+        }
+        fields[id] = r.value(header & 0x0f)
+        last = id
+    }
+}
+
+// readHybrid decodes n values of the RLE/bit-packing hybrid encoding
+func readHybrid(b []byte, width int, n int) []int {
+    r := &thriftReader{b: b}
+    var values []int
+    for len(values) < n {
+        header := r.uvarint()
+        if header&1 == 1 { // bit-packed groups of 8
+            bits := r.b[r.i : r.i+int(header>>1)*width]
+            r.i += len(bits)
+            for k := 0; k < len(bits)*8/width; k++ {
+                v := 0
+                for j := 0; j < width; j++ {
+                    bit := k*width + j
+                    v |= int(bits[bit/8]>>uint(bit%8)&1) << uint(j)
+                }
+                values = append(values, v)
+            }
+        } else { // run
+            v := 0
+            for k := 0; k < (width+7)/8; k++ {
+                v |= int(r.byte()) << uint(8*k)
+            }
+            for k := uint64(0); k < header>>1; k++ {
+                values = append(values, v)
+            }
+        }
+    }
+    return values[:n]
+}
+
+// parquetFile is what readParquet gets out of a file
+type parquetFile struct {
+    names     []string
+    rows      [][]interface{}
+    rowGroups int
+    pages     map[string]int // data pages for each column
+}
+
+func readParquet(t *testing.T, b []byte) *parquetFile {
+    t.Helper()
+    if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+        t.Fatal("missing PAR1 magic")
+    }
+    length := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+    metadata := (&thriftReader{b: b, i: len(b) - 8 - length}).structure()
+
+    file := &parquetFile{pages: map[string]int{}}
+    schema := metadata[2].([]interface{})[1:] // skip the root
+    for _, element := range schema {
+        file.names = append(file.names, string(element.(map[int]interface{})[4].([]byte)))
+    }
+
+    for _, rowGroup := range metadata[4].([]interface{}) {
+        file.rowGroups++
+        var columns [][]interface{}
+        for i, chunk := range rowGroup.(map[int]interface{})[1].([]interface{}) {
+            element := schema[i].(map[int]interface{})
+            kind := element[1].(int64)
+            optional := element[3].(int64) == repetitionOptional
+            _, utf8 := element[6]
+
+            meta := chunk.(map[int]interface{})[3].(map[int]interface{})
+            numValues := int(meta[5].(int64))
+            offset := int(meta[9].(int64))
+            if dictionaryOffset, ok := meta[11]; ok {
+                offset = int(dictionaryOffset.(int64))
+            }
+
+            var dictionary []interface{}
+            var column []interface{}
+            for len(column) < numValues {
+                r := &thriftReader{b: b, i: offset}
+                header := r.structure()
+                compressed := b[r.i : r.i+int(header[3].(int64))]
+                offset = r.i + len(compressed)
+                page, err := snappy.Decode(nil, compressed)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if len(page) != int(header[2].(int64)) {
+                    t.Fatalf("%s: page is %d bytes, header says %d", file.names[i], len(page), header[2])
+                }
+
+                if header[1].(int64) == pageDictionary {
+                    n := int(header[7].(map[int]interface{})[1].(int64))
+                    dictionary = readPlain(page, parquetByteArray, utf8, n)
+                    continue
+                }
+
+                file.pages[file.names[i]]++
+                rows := int(header[5].(map[int]interface{})[1].(int64))
+                defined := make([]int, rows)
+                for k := range defined {
+                    defined[k] = 1
+                }
+                if optional {
+                    n := int(binary.LittleEndian.Uint32(page))
+                    defined = readHybrid(page[4:4+n], 1, rows)
+                    page = page[4+n:]
+                }
+                n := 0
+                for _, d := range defined {
+                    n += d
+                }
+
+                var values []interface{}
+                switch {
+                case dictionary != nil:
+                    for _, index := range readHybrid(page[1:], int(page[0]), n) {
+                        values = append(values, dictionary[index])
+                    }
+                case kind == parquetBoolean:
+                    for k := 0; k < n; k++ {
+                        values = append(values, page[k/8]>>uint(k%8)&1 == 1)
+                    }
+                default:
+                    values = readPlain(page, kind, utf8, n)
+                }
+                for _, d := range defined {
+                    if d == 0 {
+                        column = append(column, nil)
+                    } else {
+                        column = append(column, values[0])
+                        values = values[1:]
+                    }
+                }
+            }
+            columns = append(columns, column)
+        }
+        for row := range columns[0] {
+            var values []interface{}
+            for _, column := range columns {
+                values = append(values, column[row])
+            }
+            file.rows = append(file.rows, values)
+        }
+    }
+    return file
+}
+
+// readPlain decodes n plain encoded int32, int64 or byte array values
+func readPlain(b []byte, kind int64, utf8 bool, n int) []interface{} {
+    var values []interface{}
+    for k := 0; k < n; k++ {
+        switch kind {
+        case parquetInt32:
+            values = append(values, int64(int32(binary.LittleEndian.Uint32(b))))
+            b = b[4:]
+        case parquetInt64:
+            values = append(values, int64(binary.LittleEndian.Uint64(b)))
+            b = b[8:]
+        case parquetByteArray:
+            length := int(binary.LittleEndian.Uint32(b))
+            if utf8 {
+                values = append(values, string(b[4:4+length]))
+            } else {
+                values = append(values, b[4:4+length])
+            }
+            b = b[4+length:]
+        }
+    }
+    return values
+}
+
+// TestParquetReadBack writes some coins (a few of each type, over several row groups) and checks they read back the same
+func TestParquetReadBack(t *testing.T) {
+    txid, _ := hex.DecodeString("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+    hash160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+    pubkey, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+    p2ms := append(append([]byte{0x51, 0x21}, pubkey...), 0x51, 0xae)                  // 1 <pubkey> 1 OP_CHECKMULTISIG
+    nulldata := append([]byte{0x6a, 0x08}, "CNTRPRTY"...)                              // OP_RETURN <"CNTRPRTY">
+    p2wpkh := append([]byte{0x00, 0x14}, hash160...)
+
+    coins := []*chainstate.Coin{
+        {TxID: txid, Vout: 0, Height: 1, Coinbase: true, Amount: 5000000000, NSize: 0, Script: hash160, Type: "p2pkh", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+        {TxID: txid, Vout: 1, Height: 500000, Amount: 1, NSize: 6 + int64(len(p2ms)), Script: p2ms, Type: "p2ms", Multisig: &chainstate.Multisig{M: 1, PubKeys: [][]byte{pubkey}, Valid: []bool{true}}},
+        {TxID: txid, Vout: 2, Height: 800000, Amount: 0, NSize: 6 + int64(len(nulldata)), Script: nulldata, Type: "nulldata"},
+        {TxID: txid, Vout: 3, Height: 800001, Amount: 12345, NSize: 6 + int64(len(p2wpkh)), Script: p2wpkh, Type: "p2wpkh", Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+        {TxID: txid, Vout: 4, Height: 800002, Amount: 2100000000000000, NSize: 1, Script: hash160, Type: "p2sh", Address: "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw"},
+    }
+    fields := []string{"count", "txid", "vout", "height", "coinbase", "amount", "nsize", "script", "type", "address", "ms_m", "ms_pubkeys", "payload", "protocol"}
+
+    var buf bytes.Buffer
+    p := newParquetWriter(&buf, fields, 2, []byte{0xab})
+    if err := p.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i, coin := range coins {
+        if err := p.WriteRecord(i+1, coin); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    file := readParquet(t, buf.Bytes())
+    if !reflect.DeepEqual(file.names, fields) {
+        t.Fatalf("columns %v, want %v", file.names, fields)
+    }
+    if file.rowGroups != 3 {
+        t.Errorf("%d row groups, want 3", file.rowGroups)
+    }
+    if len(file.rows) != len(coins) {
+        t.Fatalf("%d rows, want %d", len(file.rows), len(coins))
+    }
+    for i, coin := range coins {
+        want := []interface{}{int64(i + 1), hex.EncodeToString(coin.TxID), coin.Vout, coin.Height, coin.Coinbase, coin.Amount, coin.NSize, coin.Script, coin.Type, nil, nil, nil, nil, nil}
+        if coin.Address != "" {
+            want[9] = coin.Address
+        }
+        if coin.Multisig != nil {
+            want[10], want[11] = int64(coin.Multisig.M), hex.EncodeToString(pubkey)
+        }
+        if coin.Type == "nulldata" {
+            want[12], want[13] = []byte("CNTRPRTY"), "counterparty"
+        }
+        if !reflect.DeepEqual(file.rows[i], want) {
+            t.Errorf("row %d:\n got %v\nwant %v", i, file.rows[i], want)
+        }
+    }
+}
+
+// TestParquetPages checks that a big row group gets split in to pages (and still reads back)
+func TestParquetPages(t *testing.T) {
+    rows := 3000
+    fields := []string{"vout", "coinbase", "script", "type", "address"}
+
+    var buf bytes.Buffer
+    p := newParquetWriter(&buf, fields, rows, nil)
+    if err := p.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    coins := make([]*chainstate.Coin, rows)
+    for i := range coins {
+        script := bytes.Repeat([]byte{byte(i)}, 1000) // 3MB of scripts
+        coins[i] = &chainstate.Coin{Vout: int64(i), Coinbase: i%3 == 0, Script: script, Type: []string{"p2pkh", "p2sh", "non-standard"}[i%3]}
+        if i%3 != 2 {
+            coins[i].Address = fmt.Sprintf("address%d", i)
+        }
+        if err := p.WriteRecord(i+1, coins[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    file := readParquet(t, buf.Bytes())
+    if file.rowGroups != 1 {
+        t.Fatalf("%d row groups, want 1", file.rowGroups)
+    }
+    if file.pages["script"] < 3 {
+        t.Errorf("script column has %d pages, want at least 3", file.pages["script"])
+    }
+    if len(file.rows) != rows {
+        t.Fatalf("%d rows, want %d", len(file.rows), rows)
+    }
+    for i, coin := range coins {
+        want := []interface{}{coin.Vout, coin.Coinbase, coin.Script, coin.Type, nil}
+        if coin.Address != "" {
+            want[4] = coin.Address
+        }
+        if !reflect.DeepEqual(file.rows[i], want) {
+            t.Fatalf("row %d doesn't match", i)
+        }
+    }
+}
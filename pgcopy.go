@@ -0,0 +1,105 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "io"
+import "strings"
+
+// PostgreSQL COPY output
+//
+// Writes the selected fields in PostgreSQL's text COPY format (tab-separated, \N for NULL, backslash escapes),
+// so the dump can be piped straight in to a table:
+//
+//   psql -c "COPY utxos (snapshot, txid, vout, amount, type, address) FROM STDIN"
+//
+// If a snapshot id is given it's written as the first column of every row. The script, scriptpubkey and payload are written as a bytea (\\x hex).
+//
+// https://www.postgresql.org/docs/current/sql-copy.html#id-1.9.3.55.9.2
+
+// pgcopyEscaper escapes the characters that have a special meaning in text COPY
+var pgcopyEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// pgcopyWriter writes tab-separated rows for COPY ... FROM STDIN
+type pgcopyWriter struct {
+    w        io.Writer
+    plan     []fieldID
+    snapshot []byte // escaped snapshot id column and its tab (empty if not wanted)
+    line     []byte // reused for every row
+}
+
+func newPgcopyWriter(w io.Writer, fields []string, snapshot string) *pgcopyWriter {
+    p := &pgcopyWriter{w: w, plan: fieldPlan(fields)}
+    if snapshot != "" {
+        p.snapshot = append([]byte(pgcopyEscaper.Replace(snapshot)), '\t')
+    }
+    return p
+}
+
+func (p *pgcopyWriter) WriteHeader() error {
+    return nil // COPY text format doesn't have a header (the columns are listed in the COPY command)
+}
+
+func (p *pgcopyWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    line := append(p.line[:0], p.snapshot...)
+    for n, id := range p.plan {
+        if n > 0 {
+            line = append(line, '\t')
+        }
+        switch id {
+        case fieldCoinbase: // boolean
+            if coin.Coinbase {
+                line = append(line, 't')
+            } else {
+                line = append(line, 'f')
+            }
+        case fieldScript, fieldScriptPubKey: // bytea hex format (the backslash is escaped for COPY)
+            line = append(line, "\\\\x"...)
+            line = appendField(line, id, count, coin)
+        case fieldAddress: // NULL if there isn't one
+            if coin.Address == "" {
+                line = append(line, "\\N"...)
+            } else {
+                line = append(line, coin.Address...) // base58 and bech32 (nothing to escape)
+            }
+        case fieldMultisigM, fieldMultisigN, fieldMultisigPubKeys, fieldMultisigCompressed, fieldMultisigValid, fieldMultisigAddresses: // NULL if it's not a p2ms
+            if coin.Multisig == nil {
+                line = append(line, "\\N"...)
+            } else {
+                line = appendField(line, id, count, coin) // numbers, hex and addresses (nothing to escape)
+            }
+        case fieldPayload: // bytea, NULL if it isn't nulldata
+            if coin.Type == "nulldata" {
+                line = append(line, "\\\\x"...)
+                line = appendField(line, id, count, coin)
+            } else {
+                line = append(line, "\\N"...)
+            }
+        case fieldProtocol: // NULL if it's not one we know
+            if protocol := chainstate.Protocol(coin.NSize, coin.Script); protocol != "" {
+                line = append(line, protocol...)
+            } else {
+                line = append(line, "\\N"...)
+            }
+        default: // numbers, hex, opcode names and the type
+            start := len(line)
+            line = pgcopyEscape(appendField(line, id, count, coin), start)
+        }
+    }
+    p.line = append(line, '\n')
+
+    _, err := p.w.Write(p.line)
+    return err
+}
+
+// pgcopyEscape escapes the field that's been appended to b from start onwards (none of the fields have anything that needs escaping, so this only copies the field if it has to)
+func pgcopyEscape(b []byte, start int) []byte {
+    for _, c := range b[start:] {
+        if c == '\\' || c == '\t' || c == '\n' || c == '\r' {
+            return append(b[:start], pgcopyEscaper.Replace(string(b[start:]))...)
+        }
+    }
+    return b
+}
+
+func (p *pgcopyWriter) Close() error {
+    return nil
+}
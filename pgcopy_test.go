@@ -0,0 +1,77 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bytes"
+import "encoding/hex"
+import "strings"
+import "testing"
+
+func TestPgcopyEscape(t *testing.T) {
+    tests := []struct {
+        field string
+        want  string
+    }{
+        {"p2pkh", "p2pkh"},
+        {"", ""},
+        {`a\b`, `a\\b`},
+        {"a\tb", `a\tb`},
+        {"a\nb", `a\nb`},
+        {"a\rb", `a\rb`},
+        {"\\N", `\\N`}, // a field that happens to look like NULL isn't one
+        {"\\\t\n", `\\\t\n`},
+    }
+    for _, test := range tests {
+        b := pgcopyEscape(append([]byte("before\t"), test.field...), len("before\t"))
+        if got := string(b); got != "before\t"+test.want {
+            t.Errorf("%q: got %q, want %q", test.field, got, "before\t"+test.want)
+        }
+    }
+}
+
+func TestPgcopyWriter(t *testing.T) {
+    txid, _ := hex.DecodeString("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+    hash160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+    nulldata := append([]byte{0x6a, 0x08}, "CNTRPRTY"...) // OP_RETURN <"CNTRPRTY">
+    weird := []byte{0x5c, 0x09, 0x0a} // \ tab newline (written as hex, so nothing to escape)
+
+    coins := []*chainstate.Coin{
+        {TxID: txid, Vout: 0, Coinbase: true, Amount: 5000000000, NSize: 0, Script: hash160, Type: "p2pkh", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+        {TxID: txid, Vout: 1, Amount: 0, NSize: 6 + int64(len(nulldata)), Script: nulldata, Type: "nulldata"},
+        {TxID: txid, Vout: 2, Amount: 1, NSize: 6 + int64(len(weird)), Script: weird, Type: "non\\standard\t\n"}, // type with characters that need escaping
+    }
+    fields := []string{"vout", "coinbase", "amount", "script", "scriptpubkey", "type", "address", "ms_m", "ms_pubkeys", "payload", "protocol"}
+
+    var buf bytes.Buffer
+    p := newPgcopyWriter(&buf, fields, "snap\\1\t2\n")
+    if err := p.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i, coin := range coins {
+        if err := p.WriteRecord(i+1, coin); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    want := [][]string{ // columns of each row
+        {`snap\\1\t2\n`, "0", "t", "5000000000", `\\x751e76e8199196d454941c45d1b3a323f1433bd6`, `\\x76a914751e76e8199196d454941c45d1b3a323f1433bd688ac`, "p2pkh", "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", `\N`, `\N`, `\N`, `\N`},
+        {`snap\\1\t2\n`, "1", "f", "0", `\\x6a08434e545250525459`, `\\x6a08434e545250525459`, "nulldata", `\N`, `\N`, `\N`, `\\x434e545250525459`, "counterparty"},
+        {`snap\\1\t2\n`, "2", "f", "1", `\\x5c090a`, `\\x5c090a`, `non\\standard\t\n`, `\N`, `\N`, `\N`, `\N`, `\N`},
+    }
+    var rows []string
+    for _, columns := range want {
+        rows = append(rows, strings.Join(columns, "\t")+"\n")
+    }
+    if got := buf.String(); got != strings.Join(rows, "") {
+        t.Errorf("got:\n%s\nwant:\n%s", got, strings.Join(rows, ""))
+    }
+
+    // Every row has the same number of columns (nothing unescaped in the fields splits them)
+    for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+        if columns := len(strings.Split(line, "\t")); columns != len(fields)+1 {
+            t.Errorf("row %d has %d columns, want %d", i+1, columns, len(fields)+1)
+        }
+    }
+}
@@ -0,0 +1,157 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bufio"
+import "container/heap" // keeping the top n
+import "encoding/json" // json rich list
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// Rich list (-top)
+//
+// The addresses (or scripts) with the biggest balances, written to a separate file alongside the main dump:
+//
+//   rank,address,script,type,amount,percent,utxos
+//   1,bc1qgdjqv0av3q56jvd82tkdjpy7gdp9ut8tlqmgrpmv24sq90ecnvqqjwvw97,,p2wsh,24849705324947,1.25281720,1
+//
+// The balances come from an aggregateWriter (so they spill to disk if there are lots of addresses), and only the
+// top n are ever kept in memory while they're merged (in a min-heap, so the smallest of the top n is easy to replace).
+
+// richListEntry is an address in the rich list
+type richListEntry struct {
+    Rank    int     `json:"rank"`
+    Address string  `json:"address,omitempty"`
+    Script  string  `json:"script,omitempty"`
+    Type    string  `json:"type"`
+    Amount  int64   `json:"amount"`
+    Percent float64 `json:"percent"` // share of the total amount of all the utxos
+    UTXOs   int64   `json:"utxos"`
+    key     string
+    types   int64 // aggregateTotal.types
+}
+
+// richListWriter is a recordWriter that adds up the balance of every address and writes the top n to a file when it's closed
+type richListWriter struct {
+    file     string // .json for json, otherwise csv
+    n        int
+    balances *aggregateWriter
+}
+
+func newRichListWriter(file string, n int, limit int) (*richListWriter, error) {
+    if n < 1 {
+        return nil, fmt.Errorf("rich list size must be at least 1")
+    }
+    if limit < 1 {
+        return nil, fmt.Errorf("aggregate limit must be at least 1")
+    }
+    balances := &aggregateWriter{limit: limit, totals: map[string]*aggregateTotal{}} // only used for its totals
+    return &richListWriter{file: file, n: n, balances: balances}, nil
+}
+
+// richListName is the default name of the rich list file (e.g. utxodump.csv.gz -> utxodump-top.csv)
+func richListName(name string) string {
+    if name == "-" {
+        return "utxodump-top.csv"
+    }
+    dir, base := filepath.Split(name)
+    if i := strings.Index(base, "."); i > 0 {
+        base = base[:i]
+    }
+    return dir + base + "-top.csv"
+}
+
+func (r *richListWriter) WriteHeader() error {
+    return nil
+}
+
+func (r *richListWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    return r.balances.WriteRecord(count, coin)
+}
+
+// Close finds the top n balances and writes them to the file
+func (r *richListWriter) Close() error {
+    top := &richListHeap{}
+    var total int64
+    err := r.balances.merge(func(key string, balance aggregateTotal) error {
+        total += balance.amount
+        entry := richListEntry{Amount: balance.amount, UTXOs: balance.utxos, key: key, types: balance.types}
+        if top.Len() < r.n {
+            heap.Push(top, entry)
+        } else if top.less(&(*top)[0], &entry) { // bigger than the smallest in the top n
+            (*top)[0] = entry
+            heap.Fix(top, 0)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // Biggest first
+    entries := []richListEntry(*top)
+    sort.Slice(entries, func(i, j int) bool { return top.less(&entries[j], &entries[i]) })
+    for i := range entries {
+        entries[i].Rank = i + 1
+        entries[i].Type = aggregateTypeNames(entries[i].types)
+        entries[i].Address, entries[i].Script = splitAggregateKey(entries[i].key)
+        if total > 0 {
+            entries[i].Percent = float64(entries[i].Amount) * 100 / float64(total)
+        }
+    }
+
+    return r.write(entries)
+}
+
+// write saves the rich list as json (if the file ends in .json) or csv
+func (r *richListWriter) write(entries []richListEntry) error {
+    f, err := os.Create(r.file)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+
+    if strings.HasSuffix(r.file, ".json") {
+        data, err := json.MarshalIndent(entries, "", "  ")
+        if err != nil {
+            f.Close()
+            return err
+        }
+        w.Write(append(data, '\n'))
+    } else {
+        fmt.Fprintln(w, "rank,address,script,type,amount,percent,utxos")
+        for _, e := range entries {
+            fmt.Fprintf(w, "%d,%s,%s,%s,%d,%.8f,%d\n", e.Rank, e.Address, e.Script, e.Type, e.Amount, e.Percent, e.UTXOs)
+        }
+    }
+
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// richListHeap is a min-heap of the biggest balances so far
+type richListHeap []richListEntry
+
+// less orders by amount (ties are broken by key so the list is always the same)
+func (h richListHeap) less(a, b *richListEntry) bool {
+    if a.Amount != b.Amount {
+        return a.Amount < b.Amount
+    }
+    return a.key > b.key
+}
+
+func (h richListHeap) Len() int            { return len(h) }
+func (h richListHeap) Less(i, j int) bool  { return h.less(&h[i], &h[j]) }
+func (h richListHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *richListHeap) Push(x interface{}) { *h = append(*h, x.(richListEntry)) }
+func (h *richListHeap) Pop() interface{} {
+    old := *h
+    x := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return x
+}
@@ -0,0 +1,156 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "encoding/hex"
+import "encoding/json" // manifest file
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+// Sharded output
+//
+// Instead of one big file, start a new file every so many records or bytes:
+//
+//   utxodump-00000.csv
+//   utxodump-00001.csv
+//   ...
+//   utxodump-manifest.json <- name, records, total amount and sha256 of every shard
+//
+// Each shard is a complete file in the selected format (e.g. with its own csv header).
+
+// shardWriter is a recordWriter that spreads records over a number of shard files
+type shardWriter struct {
+    name        string // output file name the shard names are based on (e.g. utxodump.csv)
+    format      string
+    fields      []string
+    options     *formatOptions
+    compression string
+    maxRecords  int   // start a new shard after this many records (0 = no limit)
+    maxBytes    int64 // start a new shard after this many (uncompressed) bytes (0 = no limit)
+
+    file    *outputFile  // current shard
+    out     recordWriter // writes the format to the current shard
+    current shardInfo
+    shards  []shardInfo // finished shards
+}
+
+// shardInfo is the entry for a shard in the manifest
+type shardInfo struct {
+    File    string `json:"file"`
+    Records int    `json:"records"`
+    Amount  int64  `json:"amount"`
+    SHA256  string `json:"sha256"`
+}
+
+// shardManifest lists all the shards of a dump
+type shardManifest struct {
+    Shards    []shardInfo `json:"shards"`
+    Records   int         `json:"records"`
+    Amount    int64       `json:"amount"`
+    BestBlock string      `json:"best_block,omitempty"` // block the utxos are up to
+}
+
+func newShardWriter(name string, format string, fields []string, options *formatOptions, compression string, maxRecords int, maxBytes int64) *shardWriter {
+    return &shardWriter{name: name, format: format, fields: fields, options: options, compression: compression, maxRecords: maxRecords, maxBytes: maxBytes}
+}
+
+// shardName inserts a shard number before the extension of a file name (e.g. utxodump.csv.gz -> utxodump-00001.csv.gz)
+func shardName(name string, suffix string) string {
+    dir, base := filepath.Split(name)
+    if i := strings.Index(base, "."); i > 0 {
+        return dir + base[:i] + "-" + suffix + base[i:]
+    }
+    return dir + base + "-" + suffix
+}
+
+// manifestName is the name of the manifest file (e.g. utxodump.csv.gz -> utxodump-manifest.json)
+func manifestName(name string) string {
+    dir, base := filepath.Split(name)
+    if i := strings.Index(base, "."); i > 0 {
+        base = base[:i]
+    }
+    return dir + base + "-manifest.json"
+}
+
+// WriteHeader opens the first shard (which writes its header)
+func (s *shardWriter) WriteHeader() error {
+    return s.open()
+}
+
+// open starts a new shard
+func (s *shardWriter) open() error {
+    name := shardName(s.name, fmt.Sprintf("%05d", len(s.shards)))
+
+    file, err := createOutputFile(name, s.compression)
+    if err != nil {
+        return err
+    }
+    out, err := newRecordWriter(s.format, file, s.fields, s.options)
+    if err != nil {
+        file.Close()
+        return err
+    }
+    if err := out.WriteHeader(); err != nil {
+        file.Close()
+        return err
+    }
+
+    s.file, s.out = file, out
+    s.current = shardInfo{File: filepath.Base(name)}
+    return nil
+}
+
+// finish closes the current shard and adds it to the list for the manifest
+func (s *shardWriter) finish() error {
+    if err := s.out.Close(); err != nil {
+        return err
+    }
+    if err := s.file.Close(); err != nil {
+        return err
+    }
+    s.current.SHA256 = s.file.Checksum()
+    s.shards = append(s.shards, s.current)
+    s.file, s.out = nil, nil
+    return nil
+}
+
+func (s *shardWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+
+    // Start a new shard if the current one is full (only once there's another record to put in it, so there are no empty shards)
+    if (s.maxRecords > 0 && s.current.Records >= s.maxRecords) || (s.maxBytes > 0 && s.file.size >= s.maxBytes) {
+        if err := s.finish(); err != nil {
+            return err
+        }
+        if err := s.open(); err != nil {
+            return err
+        }
+    }
+
+    s.current.Records++
+    s.current.Amount += coin.Amount
+    return s.out.WriteRecord(count, coin)
+}
+
+// Close finishes the last shard and writes the manifest
+func (s *shardWriter) Close() error {
+    if s.out != nil {
+        if err := s.finish(); err != nil {
+            return err
+        }
+    }
+
+    manifest := shardManifest{Shards: s.shards}
+    if s.options.bestBlock != nil {
+        manifest.BestBlock = hex.EncodeToString(s.options.bestBlock)
+    }
+    for _, shard := range s.shards {
+        manifest.Records += shard.Records
+        manifest.Amount += shard.Amount
+    }
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(manifestName(s.name), append(data, '\n'), 0666)
+}
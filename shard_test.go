@@ -0,0 +1,111 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "bufio"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "os"
+import "path/filepath"
+import "testing"
+
+// TestShardManifestTotals dumps a synthetic chainstate in to shards (without amount in the output) and checks the manifest against the shard files and the coins in the chainstate
+func TestShardManifestTotals(t *testing.T) {
+    dir := t.TempDir()
+    folder := filepath.Join(dir, "chainstate")
+    if err := writeBenchChainstate(folder, 5000); err != nil {
+        t.Fatal(err)
+    }
+
+    // Totals straight from the chainstate
+    iter, _, err := openChainstate(folder, &chainstate.Options{NoAddress: true}, 1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    records, amount := 0, int64(0)
+    for iter.Next() {
+        records++
+        amount += iter.Coin().Amount
+    }
+    if err := iter.Err(); err != nil {
+        t.Fatal(err)
+    }
+    iter.Close()
+
+    // Dump just the txid and vout, the same way main does
+    fields := []string{"txid", "vout"}
+    fieldsDecoded := map[string]bool{"txid": true, "vout": true}
+    fieldsForOptions(fieldsDecoded, false, false, true)
+    options := &chainstate.Options{KeyOnly: !valueNeeded(fieldsDecoded), NoAddress: true}
+
+    iter, _, err = openChainstate(folder, options, 1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer iter.Close()
+    name := filepath.Join(dir, "utxodump.csv")
+    out := newShardWriter(name, "csv", fields, &formatOptions{}, "none", 2000, 0)
+    if err := out.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; iter.Next(); i++ {
+        if err := out.WriteRecord(i, iter.Coin()); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := iter.Err(); err != nil {
+        t.Fatal(err)
+    }
+    if err := out.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Manifest
+    data, err := os.ReadFile(manifestName(name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var manifest shardManifest
+    if err := json.Unmarshal(data, &manifest); err != nil {
+        t.Fatal(err)
+    }
+    if manifest.Records != records || manifest.Amount != amount {
+        t.Fatalf("manifest has %d records and %d satoshis, chainstate has %d and %d", manifest.Records, manifest.Amount, records, amount)
+    }
+    if len(manifest.Shards) != (records+1999)/2000 {
+        t.Fatalf("%d shards for %d records", len(manifest.Shards), records)
+    }
+
+    // Every shard file matches its entry
+    shardAmount := int64(0)
+    for _, shard := range manifest.Shards {
+        data, err := os.ReadFile(filepath.Join(dir, shard.File))
+        if err != nil {
+            t.Fatal(err)
+        }
+        sum := sha256.Sum256(data)
+        if hex.EncodeToString(sum[:]) != shard.SHA256 {
+            t.Errorf("%s: sha256 doesn't match the manifest", shard.File)
+        }
+
+        f, err := os.Open(filepath.Join(dir, shard.File))
+        if err != nil {
+            t.Fatal(err)
+        }
+        lines := 0
+        for scanner := bufio.NewScanner(f); scanner.Scan(); {
+            lines++
+        }
+        f.Close()
+        if lines-1 != shard.Records { // header
+            t.Errorf("%s: %d records, manifest says %d", shard.File, lines-1, shard.Records)
+        }
+        if shard.Amount == 0 {
+            t.Errorf("%s: amount is 0", shard.File)
+        }
+        shardAmount += shard.Amount
+    }
+    if shardAmount != manifest.Amount {
+        t.Errorf("shard amounts add up to %d, manifest total is %d", shardAmount, manifest.Amount)
+    }
+}
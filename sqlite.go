@@ -0,0 +1,219 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import _ "github.com/mattn/go-sqlite3" // sqlite driver for database/sql (needs cgo)
+import "database/sql"
+import "encoding/hex"
+import "fmt"
+import "os"
+import "strings"
+
+// SQLite output
+//
+// Writes the selected fields to a "utxos" table in a new sqlite database file, e.g.
+//
+//   sqlite3 utxodump.sqlite "SELECT txid, vout, amount FROM utxos WHERE address = '1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX'"
+//
+// The best block of the chainstate goes in a "metadata" table (key, value) so you know which block the utxos are up to.
+//
+// Rows are inserted in batched transactions, and indexes (if wanted) are built at the end because that's much faster than updating them on every insert.
+
+// sqliteBatchSize is the number of rows inserted in each transaction
+const sqliteBatchSize = 100000
+
+// sqliteIndexes are the fields that get an index when indexes are wanted
+var sqliteIndexes = []string{"address", "height", "type"}
+
+// sqliteWriter inserts each utxo in to a sqlite database
+type sqliteWriter struct {
+    db        *sql.DB
+    tx        *sql.Tx   // current transaction
+    insert    *sql.Stmt // prepared insert statement for the current transaction
+    fields    []string
+    indexes   bool   // build indexes when closing
+    bestBlock []byte // written to the metadata table
+    rows      int    // rows inserted in the current transaction
+    args      []interface{}
+}
+
+func newSQLiteWriter(file string, fields []string, indexes bool, bestBlock []byte) (*sqliteWriter, error) {
+
+    // Start with a new database (same as truncating the file for the other formats)
+    if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    db, err := sql.Open("sqlite3", file)
+    if err != nil {
+        return nil, err
+    }
+
+    // We're only ever writing a new file in one go, so don't bother with a journal or waiting for the disk
+    if _, err := db.Exec("PRAGMA journal_mode = OFF; PRAGMA synchronous = OFF;"); err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return &sqliteWriter{db: db, fields: fields, indexes: indexes, bestBlock: bestBlock, args: make([]interface{}, len(fields))}, nil
+}
+
+// sqliteColumnType is the type of column used for each field
+func sqliteColumnType(field string) string {
+    switch field {
+    case "txid", "asm", "type", "address", "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses", "protocol": // lists are space-separated
+        return "TEXT"
+    case "script", "scriptpubkey", "payload":
+        return "BLOB"
+    }
+    return "INTEGER" // count, vout, height, coinbase (0 or 1), amount, nsize, ms_m, ms_n
+}
+
+// WriteHeader creates the utxos table (and the metadata table)
+func (s *sqliteWriter) WriteHeader() error {
+    if s.bestBlock != nil {
+        if _, err := s.db.Exec("CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+            return err
+        }
+        if _, err := s.db.Exec("INSERT INTO metadata VALUES ('best_block', ?)", hex.EncodeToString(s.bestBlock)); err != nil {
+            return err
+        }
+    }
+
+    columns := make([]string, len(s.fields))
+    for i, v := range s.fields {
+        columns[i] = fmt.Sprintf("\"%s\" %s", v, sqliteColumnType(v)) // "count" INTEGER
+    }
+    if _, err := s.db.Exec(fmt.Sprintf("CREATE TABLE utxos (%s)", strings.Join(columns, ", "))); err != nil {
+        return err
+    }
+    return s.begin()
+}
+
+// begin starts a new transaction and prepares the insert statement for it
+func (s *sqliteWriter) begin() error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(s.fields)), ", ")
+    insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO utxos VALUES (%s)", placeholders))
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    s.tx, s.insert, s.rows = tx, insert, 0
+    return nil
+}
+
+// commit finishes the current transaction
+func (s *sqliteWriter) commit() error {
+    s.insert.Close()
+    err := s.tx.Commit()
+    s.tx, s.insert = nil, nil
+    return err
+}
+
+func (s *sqliteWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    for i, v := range s.fields {
+        switch v {
+        case "count":
+            s.args[i] = count
+        case "txid":
+            s.args[i] = hex.EncodeToString(coin.TxID)
+        case "vout":
+            s.args[i] = coin.Vout
+        case "height":
+            s.args[i] = coin.Height
+        case "coinbase":
+            s.args[i] = coin.Coinbase // stored as 0 or 1
+        case "amount":
+            s.args[i] = coin.Amount
+        case "nsize":
+            s.args[i] = coin.NSize
+        case "script":
+            s.args[i] = coin.Script
+        case "scriptpubkey":
+            s.args[i] = chainstate.ScriptPubKey(coin.NSize, coin.Script)
+        case "asm":
+            s.args[i] = fieldString("asm", count, coin)
+        case "type":
+            s.args[i] = coin.Type
+        case "address":
+            if coin.Address == "" {
+                s.args[i] = nil // NULL if there isn't an address
+            } else {
+                s.args[i] = coin.Address
+            }
+        case "ms_m", "ms_n", "ms_pubkeys", "ms_compressed", "ms_valid", "ms_addresses":
+            switch {
+            case coin.Multisig == nil:
+                s.args[i] = nil // NULL if it's not a p2ms
+            case v == "ms_m":
+                s.args[i] = coin.Multisig.M
+            case v == "ms_n":
+                s.args[i] = len(coin.Multisig.PubKeys)
+            default:
+                s.args[i] = fieldString(v, count, coin)
+            }
+        case "payload":
+            if coin.Type == "nulldata" {
+                s.args[i] = chainstate.AppendPayload([]byte{}, coin.NSize, coin.Script) // an empty blob if there's no data (not NULL)
+            } else {
+                s.args[i] = nil
+            }
+        case "protocol":
+            if protocol := chainstate.Protocol(coin.NSize, coin.Script); protocol != "" {
+                s.args[i] = protocol
+            } else {
+                s.args[i] = nil
+            }
+        }
+    }
+    if _, err := s.insert.Exec(s.args...); err != nil {
+        return err
+    }
+
+    // Start a new transaction every so often
+    s.rows++
+    if s.rows >= sqliteBatchSize {
+        if err := s.commit(); err != nil {
+            return err
+        }
+        return s.begin()
+    }
+    return nil
+}
+
+// Close commits the last batch, builds the indexes and closes the database
+func (s *sqliteWriter) Close() error {
+    err := s.finish()
+
+    // The database gets closed whatever happened (the first error is the one that's returned)
+    if closeErr := s.db.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+// finish commits the last transaction and builds the indexes
+func (s *sqliteWriter) finish() error {
+    if s.tx != nil {
+        if err := s.commit(); err != nil {
+            return err
+        }
+    }
+
+    if s.indexes {
+        for _, field := range sqliteIndexes {
+            for _, v := range s.fields {
+                if v == field { // can only index fields that are in the table
+                    // the names come from sqliteIndexes (not the command line), so they're fine to put straight in to the sql
+                    if _, err := s.db.Exec(fmt.Sprintf("CREATE INDEX \"utxos_%s\" ON utxos (\"%s\")", field, field)); err != nil {
+                        return err
+                    }
+                }
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "database/sql"
+import "encoding/hex"
+import "fmt"
+import "path/filepath"
+import "strings"
+import "testing"
+
+// sqliteQuery gets the rows of a query as strings (columns separated by |, NULL for nulls and hex for blobs)
+func sqliteQuery(t *testing.T, db *sql.DB, query string) []string {
+    rows, err := db.Query(query)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    columns, _ := rows.Columns()
+    var lines []string
+    for rows.Next() {
+        values := make([]interface{}, len(columns))
+        pointers := make([]interface{}, len(columns))
+        for i := range values {
+            pointers[i] = &values[i]
+        }
+        if err := rows.Scan(pointers...); err != nil {
+            t.Fatal(err)
+        }
+        line := make([]string, len(columns))
+        for i, v := range values {
+            switch v := v.(type) {
+            case nil:
+                line[i] = "NULL"
+            case []byte:
+                line[i] = hex.EncodeToString(v)
+            default:
+                line[i] = fmt.Sprint(v)
+            }
+        }
+        lines = append(lines, strings.Join(line, "|"))
+    }
+    if err := rows.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return lines
+}
+
+func TestSQLiteReadBack(t *testing.T) {
+    txid, _ := hex.DecodeString("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+    hash160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+    pubkey, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+    p2ms := append(append([]byte{0x51, 0x21}, pubkey...), 0x51, 0xae) // 1 <pubkey> 1 OP_CHECKMULTISIG
+    nulldata := append([]byte{0x6a, 0x08}, "CNTRPRTY"...)              // OP_RETURN <"CNTRPRTY">
+
+    coins := []*chainstate.Coin{
+        {TxID: txid, Vout: 0, Height: 1, Coinbase: true, Amount: 5000000000, NSize: 0, Script: hash160, Type: "p2pkh", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+        {TxID: txid, Vout: 1, Height: 500000, Amount: 1, NSize: 6 + int64(len(p2ms)), Script: p2ms, Type: "p2ms", Multisig: &chainstate.Multisig{M: 1, PubKeys: [][]byte{pubkey}, Valid: []bool{true}}},
+        {TxID: txid, Vout: 2, Height: 800000, Amount: 0, NSize: 6 + int64(len(nulldata)), Script: nulldata, Type: "nulldata"},
+    }
+    fields := []string{"count", "txid", "vout", "height", "coinbase", "amount", "scriptpubkey", "type", "address", "ms_m", "ms_pubkeys", "payload", "protocol"}
+    bestBlock, _ := hex.DecodeString("00000000000000000001a0a448d6cf2546b06801389cc030b2b18c6491266815")
+
+    for _, indexes := range []bool{true, false} {
+        file := filepath.Join(t.TempDir(), "utxodump.sqlite")
+        s, err := newSQLiteWriter(file, fields, indexes, bestBlock)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := s.WriteHeader(); err != nil {
+            t.Fatal(err)
+        }
+        for i, coin := range coins {
+            if err := s.WriteRecord(i+1, coin); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := s.Close(); err != nil {
+            t.Fatal(err)
+        }
+
+        db, err := sql.Open("sqlite3", file)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        // Rows
+        want := []string{
+            "1|4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b|0|1|1|5000000000|76a914751e76e8199196d454941c45d1b3a323f1433bd688ac|p2pkh|1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH|NULL|NULL|NULL|NULL",
+            "2|4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b|1|500000|0|1|" + hex.EncodeToString(p2ms) + "|p2ms|NULL|1|" + hex.EncodeToString(pubkey) + "|NULL|NULL",
+            "3|4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b|2|800000|0|0|" + hex.EncodeToString(nulldata) + "|nulldata|NULL|NULL|NULL|434e545250525459|counterparty",
+        }
+        if got := sqliteQuery(t, db, "SELECT * FROM utxos ORDER BY count"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+            t.Errorf("rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+        }
+
+        // Column types
+        if got := sqliteQuery(t, db, "SELECT typeof(vout), typeof(coinbase), typeof(scriptpubkey), typeof(address) FROM utxos WHERE count = 1"); got[0] != "integer|integer|blob|text" {
+            t.Errorf("column types %s", got[0])
+        }
+
+        // Metadata
+        if got := sqliteQuery(t, db, "SELECT key, value FROM metadata"); len(got) != 1 || got[0] != "best_block|"+hex.EncodeToString(bestBlock) {
+            t.Errorf("metadata %q", got)
+        }
+
+        // Indexes
+        wantIndexes := ""
+        if indexes {
+            wantIndexes = "utxos_address address,utxos_height height,utxos_type type"
+        }
+        if got := sqliteQuery(t, db, "SELECT name || ' ' || (SELECT name FROM pragma_index_info(m.name)) FROM sqlite_master m WHERE type = 'index' AND tbl_name = 'utxos' ORDER BY name"); strings.Join(got, ",") != wantIndexes {
+            t.Errorf("indexes %q, want %q", got, wantIndexes)
+        }
+        if indexes {
+            plan := sqliteQuery(t, db, "EXPLAIN QUERY PLAN SELECT amount FROM utxos WHERE address = '1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH'")
+            if !strings.Contains(strings.Join(plan, "\n"), "utxos_address") {
+                t.Errorf("query by address doesn't use the index: %q", plan)
+            }
+        }
+
+        db.Close()
+    }
+}
+
+// TestSQLiteNoBestBlock checks there's no metadata table if the best block isn't known (and no indexes for fields that aren't in the table)
+func TestSQLiteNoBestBlock(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "utxodump.sqlite")
+    s, err := newSQLiteWriter(file, []string{"vout", "amount"}, true, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    db, err := sql.Open("sqlite3", file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if got := sqliteQuery(t, db, "SELECT type, name FROM sqlite_master ORDER BY name"); strings.Join(got, ",") != "table|utxos" {
+        t.Errorf("schema %q, want just the utxos table", got)
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos and snapshot files
+import "fmt"
+import "io"
+import "strings"
+
+// txoutsetWriter writes the utxos as a snapshot file that bitcoin core can load with `bitcoin-cli loadtxoutset`
+//
+//   [magic "utxo\xff"] [version] [network magic] [base block hash] [coins count]
+//   [txid] [number of coins] [vout] [coin] [vout] [coin] ...
+//
+// The coins count isn't known until the end, so it gets filled in when the writer is closed (which is why the output has to be an uncompressed file).
+type txoutsetWriter struct {
+    w        io.Writer
+    metadata chainstate.SnapshotMetadata
+    snapshot *chainstate.SnapshotWriter
+}
+
+func newTxoutsetWriter(w io.Writer, network string, bestBlock []byte) (*txoutsetWriter, error) {
+    magic, err := chainstate.NetworkMagic(network)
+    if err != nil {
+        return nil, err
+    }
+    if bestBlock == nil {
+        return nil, fmt.Errorf("couldn't find the best block in the chainstate (needed for the snapshot's base block hash)")
+    }
+    return &txoutsetWriter{w: w, metadata: chainstate.SnapshotMetadata{NetworkMagic: magic, BaseBlockHash: bestBlock}}, nil
+}
+
+func (t *txoutsetWriter) WriteHeader() error {
+    snapshot, err := chainstate.NewSnapshotWriter(t.w, &t.metadata)
+    t.snapshot = snapshot
+    return err
+}
+
+func (t *txoutsetWriter) WriteRecord(count int, coin *chainstate.Coin) error {
+    return t.snapshot.Add(coin)
+}
+
+func (t *txoutsetWriter) Close() error {
+    return t.snapshot.Close() // writes the last txid and fills in the coins count
+}
+
+// networkFromPath guesses the network from the location of the chainstate (e.g. ~/.bitcoin/testnet3/chainstate)
+func networkFromPath(path string) string {
+    switch {
+    case strings.Contains(path, "testnet4"):
+        return "testnet4"
+    case strings.Contains(path, "testnet"):
+        return "test"
+    case strings.Contains(path, "signet"):
+        return "signet"
+    case strings.Contains(path, "regtest"):
+        return "regtest"
+    }
+    return "main"
+}
@@ -0,0 +1,311 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "encoding/hex"
+import "fmt"
+import "strconv"
+import "strings"
+
+// Filter expressions for the -where flag
+//
+//   amount >= 100000000 && type == "p2pk" && height < 200000
+//   coinbase && (type == "p2pk" || type == "p2pkh")
+//   !(address == "") || nsize > 40
+//
+// Comparisons are between a field and a value (or another field) of the same kind:
+//
+//   numbers:  vout, height, amount, nsize, ms_m, ms_n    (== != < <= > >=)
+//   strings:  txid, script, scriptpubkey, asm, type, address, payload, protocol    (== != < <= > >=)
+//   boolean:  coinbase                       (== != with true/false, or on its own)
+//
+// ms_m and ms_n are 0 if the script isn't a p2ms.
+//
+// Comparisons can be combined with && (and), || (or), ! (not) and parentheses.
+
+// whereExpr reports whether a coin matches the expression
+type whereExpr func(coin *chainstate.Coin) bool
+
+// whereKind is the kind of value a field or literal has
+type whereKind int
+
+const (
+    whereNumber whereKind = iota
+    whereString
+    whereBool
+)
+
+// whereOperand gets a value from a coin (or a constant for literals)
+type whereOperand struct {
+    kind    whereKind
+    number  func(coin *chainstate.Coin) int64
+    str     func(coin *chainstate.Coin) string
+    boolean func(coin *chainstate.Coin) bool
+}
+
+// whereFields are the fields that can be used in expressions
+var whereFields = map[string]whereOperand{
+    "vout":         {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return c.Vout }},
+    "height":       {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return c.Height }},
+    "amount":       {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return c.Amount }},
+    "nsize":        {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return c.NSize }},
+    "ms_m":         {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return int64(multisigCount(c, false)) }},
+    "ms_n":         {kind: whereNumber, number: func(c *chainstate.Coin) int64 { return int64(multisigCount(c, true)) }},
+    "txid":         {kind: whereString, str: func(c *chainstate.Coin) string { return hex.EncodeToString(c.TxID) }},
+    "script":       {kind: whereString, str: func(c *chainstate.Coin) string { return hex.EncodeToString(c.Script) }},
+    "scriptpubkey": {kind: whereString, str: func(c *chainstate.Coin) string { return hex.EncodeToString(chainstate.ScriptPubKey(c.NSize, c.Script)) }},
+    "asm":          {kind: whereString, str: func(c *chainstate.Coin) string { return fieldString("asm", 0, c) }},
+    "type":         {kind: whereString, str: func(c *chainstate.Coin) string { return c.Type }},
+    "address":      {kind: whereString, str: func(c *chainstate.Coin) string { return c.Address }},
+    "payload":      {kind: whereString, str: func(c *chainstate.Coin) string { return fieldString("payload", 0, c) }},
+    "protocol":     {kind: whereString, str: func(c *chainstate.Coin) string { return chainstate.Protocol(c.NSize, c.Script) }},
+    "coinbase":     {kind: whereBool, boolean: func(c *chainstate.Coin) bool { return c.Coinbase }},
+}
+
+// whereParser is a recursive descent parser for filter expressions
+type whereParser struct {
+    tokens []string
+    pos    int
+    fields map[string]bool // fields used in the expression (so we know what needs decoding)
+}
+
+// parseWhere parses a filter expression. It also returns the fields the expression uses.
+func parseWhere(expression string) (whereExpr, []string, error) {
+    tokens, err := whereTokenize(expression)
+    if err != nil {
+        return nil, nil, err
+    }
+    p := &whereParser{tokens: tokens, fields: map[string]bool{}}
+
+    expr, err := p.parseOr()
+    if err != nil {
+        return nil, nil, err
+    }
+    if p.pos < len(p.tokens) {
+        return nil, nil, fmt.Errorf("unexpected '%s' in -where expression", p.tokens[p.pos])
+    }
+
+    var fields []string
+    for field := range p.fields {
+        fields = append(fields, field)
+    }
+    return expr, fields, nil
+}
+
+// whereTokenize splits an expression in to tokens: operators, parentheses, "strings", numbers and names
+func whereTokenize(expression string) ([]string, error) {
+    var tokens []string
+    for i := 0; i < len(expression); {
+        c := expression[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n':
+            i++
+        case strings.HasPrefix(expression[i:], "&&") || strings.HasPrefix(expression[i:], "||") || strings.HasPrefix(expression[i:], "==") ||
+            strings.HasPrefix(expression[i:], "!=") || strings.HasPrefix(expression[i:], "<=") || strings.HasPrefix(expression[i:], ">="):
+            tokens = append(tokens, expression[i:i+2])
+            i += 2
+        case c == '<' || c == '>' || c == '!' || c == '(' || c == ')':
+            tokens = append(tokens, expression[i:i+1])
+            i++
+        case c == '"' || c == '\'': // string (up to the matching quote)
+            end := strings.IndexByte(expression[i+1:], c)
+            if end < 0 {
+                return nil, fmt.Errorf("unterminated string in -where expression")
+            }
+            tokens = append(tokens, expression[i:i+end+2])
+            i += end + 2
+        case c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-':
+            j := i + 1
+            for j < len(expression) && (expression[j] >= '0' && expression[j] <= '9' || expression[j] >= 'a' && expression[j] <= 'z' || expression[j] >= 'A' && expression[j] <= 'Z' || expression[j] == '_') {
+                j++
+            }
+            tokens = append(tokens, expression[i:j])
+            i = j
+        default:
+            return nil, fmt.Errorf("unexpected '%c' in -where expression", c)
+        }
+    }
+    return tokens, nil
+}
+
+func (p *whereParser) peek() string {
+    if p.pos < len(p.tokens) {
+        return p.tokens[p.pos]
+    }
+    return ""
+}
+
+func (p *whereParser) next() string {
+    token := p.peek()
+    p.pos++
+    return token
+}
+
+// or := and ("||" and)*
+func (p *whereParser) parseOr() (whereExpr, error) {
+    left, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "||" {
+        p.next()
+        right, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        l := left
+        left = func(c *chainstate.Coin) bool { return l(c) || right(c) }
+    }
+    return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *whereParser) parseAnd() (whereExpr, error) {
+    left, err := p.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "&&" {
+        p.next()
+        right, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        l := left
+        left = func(c *chainstate.Coin) bool { return l(c) && right(c) }
+    }
+    return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | comparison
+func (p *whereParser) parseUnary() (whereExpr, error) {
+    switch p.peek() {
+    case "!":
+        p.next()
+        expr, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return func(c *chainstate.Coin) bool { return !expr(c) }, nil
+    case "(":
+        p.next()
+        expr, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if p.next() != ")" {
+            return nil, fmt.Errorf("missing ')' in -where expression")
+        }
+        return expr, nil
+    }
+    return p.parseComparison()
+}
+
+// comparison := operand [op operand]  (an operand on its own has to be a boolean)
+func (p *whereParser) parseComparison() (whereExpr, error) {
+    left, err := p.parseOperand()
+    if err != nil {
+        return nil, err
+    }
+
+    op := p.peek()
+    switch op {
+    case "==", "!=", "<", "<=", ">", ">=":
+        p.next()
+    default:
+        if left.kind != whereBool {
+            return nil, fmt.Errorf("expected a comparison after '%s' in -where expression", p.tokens[p.pos-1])
+        }
+        return left.boolean, nil
+    }
+
+    right, err := p.parseOperand()
+    if err != nil {
+        return nil, err
+    }
+    if left.kind != right.kind {
+        return nil, fmt.Errorf("can't compare '%s' with '%s' in -where expression", p.tokens[p.pos-3], p.tokens[p.pos-1])
+    }
+
+    switch left.kind {
+    case whereNumber:
+        l, r := left.number, right.number
+        switch op {
+        case "==":
+            return func(c *chainstate.Coin) bool { return l(c) == r(c) }, nil
+        case "!=":
+            return func(c *chainstate.Coin) bool { return l(c) != r(c) }, nil
+        case "<":
+            return func(c *chainstate.Coin) bool { return l(c) < r(c) }, nil
+        case "<=":
+            return func(c *chainstate.Coin) bool { return l(c) <= r(c) }, nil
+        case ">":
+            return func(c *chainstate.Coin) bool { return l(c) > r(c) }, nil
+        case ">=":
+            return func(c *chainstate.Coin) bool { return l(c) >= r(c) }, nil
+        }
+    case whereString:
+        l, r := left.str, right.str
+        switch op {
+        case "==":
+            return func(c *chainstate.Coin) bool { return l(c) == r(c) }, nil
+        case "!=":
+            return func(c *chainstate.Coin) bool { return l(c) != r(c) }, nil
+        case "<":
+            return func(c *chainstate.Coin) bool { return l(c) < r(c) }, nil
+        case "<=":
+            return func(c *chainstate.Coin) bool { return l(c) <= r(c) }, nil
+        case ">":
+            return func(c *chainstate.Coin) bool { return l(c) > r(c) }, nil
+        case ">=":
+            return func(c *chainstate.Coin) bool { return l(c) >= r(c) }, nil
+        }
+    case whereBool:
+        l, r := left.boolean, right.boolean
+        switch op {
+        case "==":
+            return func(c *chainstate.Coin) bool { return l(c) == r(c) }, nil
+        case "!=":
+            return func(c *chainstate.Coin) bool { return l(c) != r(c) }, nil
+        }
+    }
+    return nil, fmt.Errorf("can't use '%s' to compare booleans in -where expression", op)
+}
+
+// operand := field | number | "string" | true | false
+func (p *whereParser) parseOperand() (whereOperand, error) {
+    token := p.next()
+    switch {
+    case token == "":
+        return whereOperand{}, fmt.Errorf("unexpected end of -where expression")
+    case token == "true" || token == "false":
+        b := token == "true"
+        return whereOperand{kind: whereBool, boolean: func(*chainstate.Coin) bool { return b }}, nil
+    case token[0] == '"' || token[0] == '\'':
+        s := token[1 : len(token)-1]
+        return whereOperand{kind: whereString, str: func(*chainstate.Coin) string { return s }}, nil
+    case token[0] >= '0' && token[0] <= '9' || token[0] == '-':
+        n, err := strconv.ParseInt(token, 10, 64)
+        if err != nil {
+            return whereOperand{}, fmt.Errorf("'%s' is not a number in -where expression", token)
+        }
+        return whereOperand{kind: whereNumber, number: func(*chainstate.Coin) int64 { return n }}, nil
+    }
+
+    operand, ok := whereFields[token]
+    if !ok {
+        return whereOperand{}, fmt.Errorf("'%s' is not a field you can use in -where expression (vout,height,coinbase,amount,nsize,ms_m,ms_n,script,scriptpubkey,asm,type,address,payload,protocol,txid)", token)
+    }
+    p.fields[token] = true
+    return operand, nil
+}
+
+// multisigCount gets m (or n) for a p2ms, or 0 for anything else
+func multisigCount(coin *chainstate.Coin, n bool) int {
+    switch {
+    case coin.Multisig == nil:
+        return 0
+    case n:
+        return len(coin.Multisig.PubKeys)
+    }
+    return coin.Multisig.M
+}
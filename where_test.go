@@ -0,0 +1,119 @@
+package main
+
+import "github.com/in3rsha/bitcoin-utxo-dump/bitcoin/chainstate" // decoded utxos
+import "sort"
+import "strings"
+import "testing"
+
+func TestParseWhere(t *testing.T) {
+    coins := []*chainstate.Coin{
+        {Vout: 0, Height: 100, Amount: 5000000000, Coinbase: true, Type: "p2pk"},
+        {Vout: 1, Height: 200000, Amount: 100000000, Type: "p2pkh", Address: "1KaPHfvVWNZADup3Yc26SfVdkTDvvHySVX"},
+        {Vout: 2, Height: 800000, Amount: 546, Type: "p2wpkh", Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+        {Vout: 3, Height: 800001, Amount: 0, Type: "p2ms", Multisig: &chainstate.Multisig{M: 1, PubKeys: make([][]byte, 2)}},
+    }
+
+    tests := []struct {
+        expression string
+        matches    string // which of the coins match (1 = match)
+        fields     string // fields used (sorted)
+    }{
+        // comparisons
+        {"amount >= 100000000", "1100", "amount"},
+        {"height < 200000", "1000", "height"},
+        {"vout != 2", "1101", "vout"},
+        {"vout <= 1", "1100", "vout"},
+        {"vout > 1", "0011", "vout"},
+        {"amount == 546", "0010", "amount"},
+        {"ms_m == 1 && ms_n == 2", "0001", "ms_m,ms_n"},
+        {"height > vout", "1111", "height,vout"},
+
+        // negative numbers and strings
+        {"vout > -1", "1111", "vout"},
+        {`type == "p2pk"`, "1000", "type"},
+        {`type == 'p2pkh'`, "0100", "type"},
+        {`address == ""`, "1001", "address"},
+        {`address >= "bc1"`, "0010", "address"},
+        {`type == "p2pk || p2pkh"`, "0000", "type"}, // operators in a string are just part of it
+        {`"p2wpkh" == type`, "0010", "type"},
+
+        // booleans
+        {"coinbase", "1000", "coinbase"},
+        {"!coinbase", "0111", "coinbase"},
+        {"coinbase == false", "0111", "coinbase"},
+        {"coinbase != true", "0111", "coinbase"},
+        {"true", "1111", ""},
+        {"!false && !!coinbase", "1000", "coinbase"},
+
+        // precedence: ! before && before ||
+        {`coinbase || type == "p2pkh" && amount < 100000000`, "1000", "amount,coinbase,type"},
+        {`(coinbase || type == "p2pkh") && amount < 100000000`, "0000", "amount,coinbase,type"},
+        {`type == "p2ms" || vout == 2 && height > 800000`, "0001", "height,type,vout"},
+        {`(type == "p2ms" || vout == 2) && height > 800000`, "0001", "height,type,vout"},
+        {`!coinbase && vout < 2 || vout == 3`, "0101", "coinbase,vout"},
+        {`!(coinbase && vout < 2) || vout == 3`, "0111", "coinbase,vout"},
+        {`!(address == "") || amount > 1000000000`, "1110", "address,amount"},
+        {`((vout == 0))`, "1000", "vout"},
+    }
+    for _, test := range tests {
+        expr, used, err := parseWhere(test.expression)
+        if err != nil {
+            t.Errorf("%s: %v", test.expression, err)
+            continue
+        }
+        matches := ""
+        for _, coin := range coins {
+            if expr(coin) {
+                matches += "1"
+            } else {
+                matches += "0"
+            }
+        }
+        if matches != test.matches {
+            t.Errorf("%s: matched %s, want %s", test.expression, matches, test.matches)
+        }
+        sort.Strings(used)
+        if strings.Join(used, ",") != test.fields {
+            t.Errorf("%s: uses %v, want %s", test.expression, used, test.fields)
+        }
+    }
+}
+
+func TestParseWhereErrors(t *testing.T) {
+    tests := []struct {
+        expression string
+        err        string // part of the error message
+    }{
+        {`type == "p2pk`, "unterminated string"},
+        {`type == 'p2pk"`, "unterminated string"},
+        {"colour == 1", "'colour' is not a field"},
+        {`amount == "1"`, "can't compare"},
+        {"coinbase == 1", "can't compare"},
+        {`type == 5`, "can't compare"},
+        {"coinbase < true", "can't use '<' to compare booleans"},
+        {"amount > 1 2", "unexpected '2'"},
+        {"vout == 1 )", "unexpected ')'"},
+        {"amount - 1", "expected a comparison after 'amount'"},
+        {"amount", "expected a comparison after 'amount'"},
+        {"amount >=", "unexpected end"},
+        {"amount > 1 &&", "unexpected end"},
+        {"|| coinbase", "is not a field"},
+        {"!", "unexpected end"},
+        {"", "unexpected end"},
+        {"(vout == 1", "missing ')'"},
+        {"vout == 99999999999999999999", "is not a number"},
+        {"vout == 1a", "is not a number"},
+        {"amount > 1 & coinbase", "unexpected '&'"},
+        {"vout = 1", "unexpected '='"},
+    }
+    for _, test := range tests {
+        _, _, err := parseWhere(test.expression)
+        if err == nil {
+            t.Errorf("%s: no error, want %q", test.expression, test.err)
+            continue
+        }
+        if !strings.Contains(err.Error(), test.err) {
+            t.Errorf("%s: got %q, want %q", test.expression, err, test.err)
+        }
+    }
+}